@@ -1,17 +1,21 @@
 namespace = "default"
-path      = "nomadops/v1/gitrepository/testrepo"
+path      = "nomadops/v2/gitrepository/testrepo"
 
 items {
+  api_version     = "nomadops/v2"
+  kind            = "GitRepository"
   controller_name = "nomadops"
 
-  // For remote usage
-  url  = "https://github.com/Antvirf/nomad-proto"
-  type = "remote-repository" // or local directory
-
-  // For local usage, e.g. dev - point url any local directory, do not sync from a remote. That local url is then copied to another tmp location for operations
-  // url  = "/home/antti/dev/nomad-proto/"
-  // type = "local-directory"
-
-  branch = "main"
+  // For remote usage, set `type` to "remote-repository".
+  // For local usage, e.g. dev - point `url` to any local directory and set `type` to "local-directory", do not sync from a remote.
+  // That local url is then copied to another tmp location for operations, e.g. "url": "/home/antti/dev/nomad-proto/"
+  spec = <<EOF
+{
+  "url": "https://github.com/Antvirf/nomad-proto",
+  "type": "remote-repository",
+  "ref": {
+    "branch": "main"
+  }
+}
+EOF
 }
-
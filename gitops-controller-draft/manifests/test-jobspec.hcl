@@ -1,18 +1,30 @@
 namespace = "default"
-path      = "nomadops/v1/nomadjobgroup/testjob"
+path      = "nomadops/v2/nomadjobgroup/testjob"
 
 items {
-  controller_name     = "nomadops"
-  git_repository_name = "nomadops/v1/gitrepository/testrepo" // refers to the Nomad Variable Path of the GitRepository
+  api_version     = "nomadops/v2"
+  kind            = "NomadJobGroup"
+  controller_name = "nomadops"
 
-  // Where to find .hcl files that describe Nomad Jobs
-  nomad_job_relative_path     = "gitops-controller-draft"
-  nomad_job_regex_path_filter = "job-.*.nomad.hcl"
-
-  // Where to find .hcl files that describe NomadJobGroups
-  nomad_job_group_relative_path     = "gitops-controller-draft/manifests"
-  nomad_job_group_regex_path_filter = ".*.-jobspec.hcl"
-
-  spec   = "WIP, doesn't do anything at the moment" // WIP
-  status = "WIP, doesn't do anything at the moment" // WIP
+  // `source_ref` refers to the Nomad Variable Path of the GitRepository
+  // `jobs` defines where to find .hcl files that describe Nomad Jobs
+  // `job_groups` defines where to find .hcl files that describe NomadJobGroups
+  // `git_repositories` defines where to find .hcl files that describe GitRepositories
+  spec = <<EOF
+{
+  "source_ref": "nomadops/v2/gitrepository/testrepo",
+  "jobs": {
+    "path": "gitops-controller-draft",
+    "regex_filter": "job-.*.nomad.hcl"
+  },
+  "job_groups": {
+    "path": "gitops-controller-draft/manifests",
+    "regex_filter": ".*.-jobspec.hcl"
+  },
+  "git_repositories": {
+    "path": "gitops-controller-draft/manifests",
+    "regex_filter": ".*-gitrepo.hcl"
+  }
+}
+EOF
 }
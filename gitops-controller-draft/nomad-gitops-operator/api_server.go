@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// The controller serves a small HTTP API on NOMAD_GITOPS_API_ADDRESS, disabled by default. If NOMAD_GITOPS_API_TOKEN
+// is set, requests must carry it as `Authorization: Bearer <token>`. Endpoints:
+//   - GET /v1/health
+//   - POST /v1/sync-window-override, with `{"path": "<NomadJobGroup path>", "duration": "1h"}`: sync regardless of windows
+//   - DELETE /v1/sync-window-override?path=<NomadJobGroup path>: remove an override
+//   - POST /v1/approvals, with `{"path": "<NomadJobGroup path>", "commit": "<commit>"}`: approve a commit of a group with
+//     `approval_required`, see approvals.go
+//
+// Approvals are only served with NOMAD_GITOPS_API_APPROVER_TOKENS set, e.g. `{"alice": "<token>"}`, and have to carry
+// the token of an approver instead, whose name is recorded as the approver.
+const DEFAULT_SYNC_WINDOW_OVERRIDE_DURATION = time.Hour
+
+func ServeApi(store ObjectStore) {
+	handler, approvers := newApiHandler(store)
+	logger.Info("starting API server",
+		zap.String("address", API_ADDRESS),
+		zap.Int("approvers", approvers),
+	)
+	err := http.ListenAndServe(API_ADDRESS, handler)
+	logger.Error("API server stopped",
+		zap.Error(err),
+	)
+}
+
+func newApiHandler(store ObjectStore) (handler http.Handler, approvers int) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/health", func(writer http.ResponseWriter, request *http.Request) {
+		writeApiResponse(writer, http.StatusOK, map[string]string{"status": "ok"})
+	})
+	mux.HandleFunc("POST /v1/sync-window-override", func(writer http.ResponseWriter, request *http.Request) {
+		body := struct {
+			Path     string `json:"path"`
+			Duration string `json:"duration"`
+		}{}
+		err := json.NewDecoder(request.Body).Decode(&body)
+		if err != nil {
+			writeApiError(writer, http.StatusBadRequest, "invalid request body: "+err.Error())
+			return
+		}
+		duration := DEFAULT_SYNC_WINDOW_OVERRIDE_DURATION
+		if body.Duration != "" {
+			duration, err = time.ParseDuration(body.Duration)
+			if err != nil || duration <= 0 {
+				writeApiError(writer, http.StatusBadRequest, "invalid duration "+body.Duration)
+				return
+			}
+		}
+		if !checkNomadJobGroupExists(store, writer, body.Path) {
+			return
+		}
+		until := time.Now().Add(duration)
+		SetSyncWindowOverride(body.Path, until)
+		logger.Info("sync window override set through the API",
+			zap.String("nomadJobGroup", body.Path),
+			zap.Time("until", until),
+		)
+		writeApiResponse(writer, http.StatusOK, map[string]string{"path": body.Path, "until": until.Format(time.RFC3339)})
+	})
+	mux.HandleFunc("DELETE /v1/sync-window-override", func(writer http.ResponseWriter, request *http.Request) {
+		path := request.URL.Query().Get("path")
+		if !checkNomadJobGroupExists(store, writer, path) {
+			return
+		}
+		SetSyncWindowOverride(path, time.Time{})
+		logger.Info("sync window override removed through the API",
+			zap.String("nomadJobGroup", path),
+		)
+		writeApiResponse(writer, http.StatusOK, map[string]string{"path": path})
+	})
+
+	approver_tokens := map[string]string{}
+	if API_APPROVER_TOKENS != "" {
+		err := json.Unmarshal([]byte(API_APPROVER_TOKENS), &approver_tokens)
+		if err != nil {
+			logger.Error("failed to parse NOMAD_GITOPS_API_APPROVER_TOKENS, approvals through the API are disabled",
+				zap.Error(err),
+			)
+			approver_tokens = map[string]string{}
+		}
+	}
+	approvals_handler := func(writer http.ResponseWriter, request *http.Request) {
+		approved_by := getApprover(approver_tokens, request)
+		if approved_by == "" {
+			writeApiError(writer, http.StatusUnauthorized, "missing or invalid approver token")
+			return
+		}
+		body := struct {
+			Path    string `json:"path"`
+			Commit  string `json:"commit"`
+			Comment string `json:"comment"`
+		}{}
+		err := json.NewDecoder(request.Body).Decode(&body)
+		if err != nil {
+			writeApiError(writer, http.StatusBadRequest, "invalid request body: "+err.Error())
+			return
+		}
+		if body.Commit == "" {
+			writeApiError(writer, http.StatusBadRequest, "commit is required")
+			return
+		}
+		if !checkNomadJobGroupExists(store, writer, body.Path) {
+			return
+		}
+		approval := ApprovalRecord{
+			Commit:     body.Commit,
+			ApprovedBy: approved_by,
+			ApprovedAt: time.Now().Format(time.RFC3339),
+			Comment:    body.Comment,
+			Source:     APPROVAL_SOURCE_API,
+		}
+		err = WriteApproval(store, controller_namespace, body.Path, approval)
+		if err != nil {
+			writeApiError(writer, http.StatusInternalServerError, err.Error())
+			return
+		}
+		logger.Info("approval recorded through the API",
+			zap.String("nomadJobGroup", body.Path),
+			zap.String("commit", approval.Commit),
+			zap.String("approvedBy", approval.ApprovedBy),
+		)
+		writeApiResponse(writer, http.StatusOK, approval)
+	}
+
+	// Approvals are authenticated by the approver tokens only, everything else by NOMAD_GITOPS_API_TOKEN
+	root_mux := http.NewServeMux()
+	root_mux.Handle("/", authenticateApiRequests(mux))
+	if len(approver_tokens) > 0 {
+		root_mux.HandleFunc("POST /v1/approvals", approvals_handler)
+	}
+	return root_mux, len(approver_tokens)
+}
+
+func authenticateApiRequests(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		token, _ := strings.CutPrefix(request.Header.Get("Authorization"), "Bearer ")
+		if API_TOKEN != "" && subtle.ConstantTimeCompare([]byte(token), []byte(API_TOKEN)) != 1 {
+			writeApiError(writer, http.StatusUnauthorized, "missing or invalid token")
+			return
+		}
+		handler.ServeHTTP(writer, request)
+	})
+}
+
+// getApprover returns the name of the approver whose token the request carries, or an empty string if none
+func getApprover(approver_tokens map[string]string, request *http.Request) (approved_by string) {
+	token, has_token := strings.CutPrefix(request.Header.Get("Authorization"), "Bearer ")
+	if !has_token || token == "" {
+		return ""
+	}
+	for name, approver_token := range approver_tokens {
+		if approver_token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(approver_token)) == 1 {
+			approved_by = name
+		}
+	}
+	return
+}
+
+// checkNomadJobGroupExists writes an error response unless the path is that of an existing NomadJobGroup
+func checkNomadJobGroupExists(store ObjectStore, writer http.ResponseWriter, path string) bool {
+	is_group_path := false
+	for _, prefix := range NOMAD_VAR_NOMADJOB_PREFIXES {
+		is_group_path = is_group_path || strings.HasPrefix(path, prefix)
+	}
+	if !is_group_path {
+		writeApiError(writer, http.StatusBadRequest, "not a NomadJobGroup path: "+path)
+		return false
+	}
+	object, err := store.Get(path)
+	if err != nil {
+		writeApiError(writer, http.StatusInternalServerError, err.Error())
+		return false
+	}
+	if object == nil {
+		writeApiError(writer, http.StatusNotFound, "NomadJobGroup not found: "+path)
+		return false
+	}
+	return true
+}
+
+func writeApiResponse(writer http.ResponseWriter, status_code int, body interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status_code)
+	json.NewEncoder(writer).Encode(body)
+}
+
+func writeApiError(writer http.ResponseWriter, status_code int, message string) {
+	writeApiResponse(writer, status_code, map[string]string{"error": message})
+}
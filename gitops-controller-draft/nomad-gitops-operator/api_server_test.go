@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestApiApprovals(t *testing.T) {
+	tests := []struct {
+		name            string
+		api_token       string
+		approver_tokens string
+		token           string
+		status_code     int
+		approved_by     string
+	}{
+		{"disabled without approver tokens", "", "", "", http.StatusNotFound, ""},
+		{"disabled without approver tokens, with an API token", "secret", "", "secret", http.StatusNotFound, ""},
+		{"invalid approver tokens", "", `["alice"]`, "alice-token", http.StatusNotFound, ""},
+		{"missing token", "", `{"alice": "alice-token"}`, "", http.StatusUnauthorized, ""},
+		{"API token is not an approver token", "secret", `{"alice": "alice-token"}`, "secret", http.StatusUnauthorized, ""},
+		{"approver from the token", "", `{"alice": "alice-token", "bob": "bob-token"}`, "bob-token", http.StatusOK, "bob"},
+		{"approver token without the API token", "secret", `{"alice": "alice-token"}`, "alice-token", http.StatusOK, "alice"},
+	}
+	defer func(api_token string, approver_tokens string) {
+		API_TOKEN, API_APPROVER_TOKENS = api_token, approver_tokens
+	}(API_TOKEN, API_APPROVER_TOKENS)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			API_TOKEN, API_APPROVER_TOKENS = test.api_token, test.approver_tokens
+			store := NewFileStore(t.TempDir())
+			group_path := NOMAD_VAR_NOMADJOB_PREFIXES[0] + "app"
+			if err := store.Put(&StoredObject{Path: group_path, Items: map[string]string{"spec": "{}"}}); err != nil {
+				t.Fatal(err)
+			}
+			handler, _ := newApiHandler(store)
+
+			// approved_by in the body is not taken as the approver
+			body := `{"path": "` + group_path + `", "commit": "abc", "approved_by": "mallory"}`
+			request := httptest.NewRequest(http.MethodPost, "/v1/approvals", strings.NewReader(body))
+			if test.token != "" {
+				request.Header.Set("Authorization", "Bearer "+test.token)
+			}
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+			if recorder.Code != test.status_code {
+				t.Fatalf("got status %d (%s), want %d", recorder.Code, recorder.Body, test.status_code)
+			}
+
+			approval, err := ReadApproval(store, group_path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.approved_by == "" {
+				if approval != nil {
+					t.Fatalf("got approval %+v, want none", approval)
+				}
+				return
+			}
+			if approval == nil || approval.ApprovedBy != test.approved_by || approval.Commit != "abc" {
+				t.Fatalf("got approval %+v, want commit abc approved by %s", approval, test.approved_by)
+			}
+		})
+	}
+}
+
+func TestGetApprovalPath(t *testing.T) {
+	v1_path, v2_path := GetApprovalPath(NOMAD_VAR_NOMADJOB_PREFIXES[0]+"app"), GetApprovalPath(NOMAD_VAR_NOMADJOB_PREFIXES[1]+"app")
+	if v1_path == v2_path {
+		t.Fatalf("groups of the same name under different prefixes share the approval %s", v1_path)
+	}
+	if expected := "nomadops/approvals/v2/nomadjobgroup/app"; v2_path != expected {
+		t.Fatalf("got %s, want %s", v2_path, expected)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/nomad/api"
+)
+
+// NomadJobGroups with `approval_required` only apply a new commit once it is approved. Until then the controller
+// stores the planned changes in the status as `awaiting_approval`. An approval is an object in the object store, e.g.
+// a Nomad Variable, at `nomadops/approvals/<group path without nomadops/>`, written by hand or through the API:
+//
+//	nomad var put nomadops/approvals/v2/nomadjobgroup/app commit=<commit> approved_by=alice comment="release 1.4"
+//
+// An approval only applies to its exact commit, so it expires once a newer commit supersedes it. Applied approvals are
+// recorded in the status of the group as an audit trail. Approvals written by hand name their approver themselves, so
+// writing them should be restricted with ACLs; through the API, the approver is the name of the token used.
+const (
+	APPROVALS_PATH           = "approvals/"
+	APPROVAL_SOURCE_API      = "api"
+	APPROVAL_SOURCE_VARIABLE = "variable"
+	MAX_APPROVAL_RECORDS     = 20
+	MAX_PLAN_CHANGES_PER_JOB = 50
+)
+
+// GetApprovalPath returns where approvals of a NomadJobGroup are stored, e.g. `nomadops/approvals/v2/nomadjobgroup/app`
+// for the group `nomadops/v2/nomadjobgroup/app`, keeping the version so that groups of the same name don't share it
+func GetApprovalPath(group_path string) string {
+	return NOMAD_VAR_PREFIX + APPROVALS_PATH + strings.TrimPrefix(group_path, NOMAD_VAR_PREFIX)
+}
+
+// ReadApproval returns the latest approval recorded for a NomadJobGroup, or nil if there is none
+func ReadApproval(store ObjectStore, group_path string) (*ApprovalRecord, error) {
+	object, err := store.Get(GetApprovalPath(group_path))
+	if err != nil || object == nil {
+		return nil, err
+	}
+	source := object.Items["source"]
+	if source == "" {
+		source = APPROVAL_SOURCE_VARIABLE
+	}
+	return &ApprovalRecord{
+		Commit:     object.Items["commit"],
+		ApprovedBy: object.Items["approved_by"],
+		ApprovedAt: object.Items["approved_at"],
+		Comment:    object.Items["comment"],
+		Source:     source,
+	}, nil
+}
+
+// WriteApproval records an approval for a NomadJobGroup, replacing any earlier one
+func WriteApproval(store ObjectStore, namespace string, group_path string, approval ApprovalRecord) error {
+	object := &StoredObject{
+		Namespace: namespace,
+		Path:      GetApprovalPath(group_path),
+		Items: map[string]string{
+			"commit":      approval.Commit,
+			"approved_by": approval.ApprovedBy,
+			"approved_at": approval.ApprovedAt,
+			"comment":     approval.Comment,
+			"source":      approval.Source,
+		},
+	}
+	existing, err := store.Get(object.Path)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		object.ModifyIndex = existing.ModifyIndex
+	}
+	return store.Put(object)
+}
+
+// appendApprovalRecord adds an applied approval to the audit trail, keeping at most MAX_APPROVAL_RECORDS
+func appendApprovalRecord(records []ApprovalRecord, approval ApprovalRecord) []ApprovalRecord {
+	if approval.ApprovedAt == "" {
+		approval.ApprovedAt = time.Now().Format(time.RFC3339) // when the controller first saw it, for hand-written approvals
+	}
+	records = append(records, approval)
+	return records[max(len(records)-MAX_APPROVAL_RECORDS, 0):]
+}
+
+// SummarizeJobDiff lists the changes of the annotated diff of a planned job, e.g. `group web: task nginx: Config[image]: "nginx:1.25" => "nginx:1.27"`
+func SummarizeJobDiff(diff *api.JobDiff) (changes []string) {
+	if diff == nil || diff.Type == "None" {
+		return nil
+	}
+	changes = summarizeDiffFields("", diff.Fields, diff.Objects)
+	for _, group := range diff.TaskGroups {
+		if group.Type == "None" {
+			continue
+		}
+		group_prefix := "group " + group.Name + ": "
+		if group.Type == "Added" || group.Type == "Deleted" {
+			changes = append(changes, group_prefix+strings.ToLower(group.Type))
+		}
+		changes = append(changes, summarizeDiffFields(group_prefix, group.Fields, group.Objects)...)
+		for _, task := range group.Tasks {
+			if task.Type == "None" {
+				continue
+			}
+			task_prefix := group_prefix + "task " + task.Name + ": "
+			if task.Type == "Added" || task.Type == "Deleted" {
+				changes = append(changes, task_prefix+strings.ToLower(task.Type))
+			}
+			if len(task.Annotations) > 0 {
+				changes = append(changes, task_prefix+strings.Join(task.Annotations, ", "))
+			}
+			changes = append(changes, summarizeDiffFields(task_prefix, task.Fields, task.Objects)...)
+		}
+	}
+	if len(changes) > MAX_PLAN_CHANGES_PER_JOB {
+		changes = append(changes[:MAX_PLAN_CHANGES_PER_JOB], fmt.Sprintf("... and %d more changes", len(changes)-MAX_PLAN_CHANGES_PER_JOB))
+	}
+	return
+}
+
+func summarizeDiffFields(prefix string, fields []*api.FieldDiff, objects []*api.ObjectDiff) (changes []string) {
+	for _, field := range fields {
+		if field.Type != "None" {
+			change := fmt.Sprintf("%s%s: %q => %q", prefix, field.Name, field.Old, field.New)
+			if len(field.Annotations) > 0 {
+				change += " (" + strings.Join(field.Annotations, ", ") + ")" // e.g. `forces create/destroy update`
+			}
+			changes = append(changes, change)
+		}
+	}
+	for _, object := range objects {
+		if object.Type != "None" {
+			changes = append(changes, summarizeDiffFields(prefix+object.Name+".", object.Fields, object.Objects)...)
+		}
+	}
+	return
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/nomad/api"
+)
+
+// With `canary_analysis` set on a NomadJobGroup, deployments with canaries are promoted by the controller once all
+// canaries have been healthy for the soak time and the Prometheus checks pass, and failed if any check does not pass:
+//
+//	"canary_analysis": {
+//	  "soak_time": "5m",
+//	  "checks": [{"name": "error rate", "query": "sum(rate(http_errors_total{job=\"{{job}}\"}[5m]))", "max": 0.1}]
+//	}
+//
+// Queries can reference `{{job}}`, `{{namespace}}` and `{{deployment}}`. Every sample of the query result must be
+// within `min` and `max`, and a query without results fails the check. Checks run once the soak time has passed. The
+// analysis runs each time the controller checks on a running deployment, and needs a deployment timeout longer than the
+// soak time.
+const (
+	CANARY_ACTION_WAIT    = ""
+	CANARY_ACTION_PROMOTE = "promote"
+	CANARY_ACTION_FAIL    = "fail"
+
+	PROMETHEUS_QUERY_TIMEOUT = 10 * time.Second
+)
+
+// ValidateCanaryAnalysis checks that canary analysis has a deployment timeout longer than its soak time. Without one, a
+// deployment whose analysis can't complete, e.g. as Prometheus is unreachable, would await promotion forever, as
+// Nomad's progress deadline doesn't apply to deployments waiting to be promoted.
+func ValidateCanaryAnalysis(analysis *CanaryAnalysis, deployment_timeout time.Duration) error {
+	if analysis == nil {
+		return nil
+	}
+	soak_time, err := time.ParseDuration(analysis.SoakTime)
+	if err != nil {
+		return fmt.Errorf("invalid canary_analysis soak_time %q: %w", analysis.SoakTime, err)
+	}
+	if deployment_timeout == 0 {
+		return errors.New("canary_analysis needs a deployment_timeout, to fail deployments whose analysis doesn't complete")
+	}
+	if soak_time >= deployment_timeout {
+		return fmt.Errorf("canary_analysis soak_time %s has to be shorter than the deployment_timeout %s", soak_time, deployment_timeout)
+	}
+	return nil
+}
+
+// analyzeCanaries decides whether to promote or fail a running deployment with canaries, or to wait
+func analyzeCanaries(client *api.Client, deployment *api.Deployment, analysis *CanaryAnalysis, query_options *api.QueryOptions) (action string, reason string, err error) {
+	soak_time, err := time.ParseDuration(analysis.SoakTime)
+	if err != nil {
+		return CANARY_ACTION_WAIT, "", fmt.Errorf("invalid canary_analysis soak_time %q: %w", analysis.SoakTime, err)
+	}
+
+	canary_ids := []string{}
+	for _, state := range deployment.TaskGroups {
+		if state.DesiredCanaries == 0 || state.Promoted {
+			continue
+		}
+		if len(state.PlacedCanaries) < state.DesiredCanaries {
+			return CANARY_ACTION_WAIT, "", nil // not all canaries placed yet
+		}
+		canary_ids = append(canary_ids, state.PlacedCanaries...)
+	}
+	if len(canary_ids) == 0 {
+		return CANARY_ACTION_WAIT, "", nil // no canaries, or already promoted
+	}
+
+	// The soak time starts once the last of the canaries became healthy
+	healthy_since := time.Time{}
+	for _, canary_id := range canary_ids {
+		allocation, _, err := client.Allocations().Info(canary_id, query_options)
+		if err != nil {
+			return CANARY_ACTION_WAIT, "", err
+		}
+		if allocation.DeploymentStatus == nil || allocation.DeploymentStatus.Healthy == nil {
+			return CANARY_ACTION_WAIT, "", nil // health not known yet
+		}
+		if !*allocation.DeploymentStatus.Healthy {
+			return CANARY_ACTION_FAIL, "canary allocation " + canary_id + " is unhealthy", nil
+		}
+		if allocation.DeploymentStatus.Timestamp.After(healthy_since) {
+			healthy_since = allocation.DeploymentStatus.Timestamp
+		}
+	}
+	if time.Since(healthy_since) < soak_time {
+		return CANARY_ACTION_WAIT, "", nil
+	}
+
+	placeholders := strings.NewReplacer("{{job}}", deployment.JobID, "{{namespace}}", deployment.Namespace, "{{deployment}}", deployment.ID)
+	for _, check := range analysis.Checks {
+		failure, err := runPrometheusCheck(analysis.PrometheusAddress, check, placeholders.Replace(check.Query))
+		if err != nil {
+			return CANARY_ACTION_WAIT, "", fmt.Errorf("failed to run canary check %q: %w", check.Name, err)
+		}
+		if failure != "" {
+			return CANARY_ACTION_FAIL, fmt.Sprintf("canary check %q failed: %s", check.Name, failure), nil
+		}
+	}
+	return CANARY_ACTION_PROMOTE, fmt.Sprintf("canaries healthy for %s and %d checks passed", soak_time, len(analysis.Checks)), nil
+}
+
+// runPrometheusCheck runs an instant query, returning why the check failed, or an empty string if it passed
+func runPrometheusCheck(prometheus_address string, check PrometheusCheck, query string) (failure string, err error) {
+	if prometheus_address == "" {
+		prometheus_address = PROMETHEUS_ADDRESS
+	}
+	if prometheus_address == "" {
+		return "", errors.New("no Prometheus address set in canary_analysis or NOMAD_GITOPS_PROMETHEUS_ADDRESS")
+	}
+	http_client := http.Client{Timeout: PROMETHEUS_QUERY_TIMEOUT}
+	response, err := http_client.Get(strings.TrimSuffix(prometheus_address, "/") + "/api/v1/query?query=" + url.QueryEscape(query))
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	var result struct {
+		Status string `json:"status"`
+		Error  string `json:"error"`
+		Data   struct {
+			ResultType string          `json:"resultType"`
+			Result     json.RawMessage `json:"result"`
+		} `json:"data"`
+	}
+	err = json.NewDecoder(response.Body).Decode(&result)
+	if err != nil {
+		return "", fmt.Errorf("invalid response from Prometheus (%s): %w", response.Status, err)
+	}
+	if result.Status != "success" {
+		return "", fmt.Errorf("query failed: %s", result.Error)
+	}
+
+	// Instant vectors hold samples of `[timestamp, "value"]`, scalars are a single such sample
+	samples := [][]interface{}{}
+	switch result.Data.ResultType {
+	case "vector":
+		vector := []struct {
+			Value []interface{} `json:"value"`
+		}{}
+		err = json.Unmarshal(result.Data.Result, &vector)
+		for _, sample := range vector {
+			samples = append(samples, sample.Value)
+		}
+	case "scalar":
+		sample := []interface{}{}
+		err = json.Unmarshal(result.Data.Result, &sample)
+		samples = append(samples, sample)
+	default:
+		return "", fmt.Errorf("unsupported result type %q, expected an instant vector or a scalar", result.Data.ResultType)
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(samples) == 0 {
+		return "query returned no data", nil
+	}
+
+	for _, sample := range samples {
+		if len(sample) != 2 {
+			return "", fmt.Errorf("unexpected sample %v", sample)
+		}
+		value_string, _ := sample[1].(string)
+		value, err := strconv.ParseFloat(value_string, 64)
+		if err != nil {
+			return "", fmt.Errorf("unexpected sample value %v", sample[1])
+		}
+		if check.Min != nil && value < *check.Min {
+			return fmt.Sprintf("value %g is below the minimum of %g", value, *check.Min), nil
+		}
+		if check.Max != nil && value > *check.Max {
+			return fmt.Sprintf("value %g is above the maximum of %g", value, *check.Max), nil
+		}
+	}
+	return "", nil
+}
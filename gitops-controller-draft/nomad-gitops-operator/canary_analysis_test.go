@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestValidateCanaryAnalysis(t *testing.T) {
+	tests := []struct {
+		name               string
+		analysis           *CanaryAnalysis
+		deployment_timeout time.Duration
+		valid              bool
+	}{
+		{"no canary analysis", nil, 0, true},
+		{"soak time within the timeout", &CanaryAnalysis{SoakTime: "5m"}, 10 * time.Minute, true},
+		{"without a timeout", &CanaryAnalysis{SoakTime: "5m"}, 0, false},
+		{"soak time as long as the timeout", &CanaryAnalysis{SoakTime: "10m"}, 10 * time.Minute, false},
+		{"invalid soak time", &CanaryAnalysis{SoakTime: "soon"}, 10 * time.Minute, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := ValidateCanaryAnalysis(test.analysis, test.deployment_timeout)
+			if (err == nil) != test.valid {
+				t.Fatalf("got error %v, want valid %t", err, test.valid)
+			}
+		})
+	}
+}
@@ -2,17 +2,17 @@ package main
 
 import (
 	"os"
+	"time"
 
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/plumbing"
-	"github.com/hashicorp/nomad/api"
 	"go.uber.org/zap"
 )
 
-func ControllerGitRepository(client *api.Client) {
+func ControllerGitRepository(store ObjectStore) {
 	logger.Info("starting controller: GitRepository")
 
-	git_repositories := FetchGitRepositoriesForController(client)
+	git_repositories := FetchGitRepositoriesForController(store)
 
 	// Main loop - get GitRepositories, clone them to local filesystem
 	for _, repo := range git_repositories {
@@ -39,27 +39,32 @@ func ControllerGitRepository(client *api.Client) {
 		}
 
 		// If type of repo is local-directory, we just clone that local dir using the `url` to the right place
-		if repo.Items.Type == "local-directory" {
+		if repo.Spec.Type == "local-directory" {
 			logger.Info("copying GitRepository from a 'local-directory'",
-				zap.String("localPath", repo.Items.Url),
+				zap.String("localPath", repo.Spec.Url),
 				zap.String("destination", base_path_plus_hash),
 				zap.String("gitRepository", repo.Path),
 			)
 			os.Remove(base_path_plus_hash)
-			err := CopyDir(repo.Items.Url, base_path_plus_hash)
+			err := CopyDir(repo.Spec.Url, base_path_plus_hash)
 			if err != nil {
 				logger.Error("failed to copy local directory",
 					zap.Error(err),
 				)
+				repo.Status.Message = "failed to copy local directory: " + err.Error()
+				repo.Status.Events = appendStatusEvent(repo.Status.Events, "SyncFailed", repo.Status.Message)
+			} else {
+				repo.Status.Message = ""
 			}
+			updateGitRepositoryStatusAfterSync(store, repo)
 			continue // end this loop here for this GitRepository instance - for `local-directory` we are done.
 		}
 
 		// Handle cloning
 		repository, err := git.PlainClone(base_path_plus_hash, false, &git.CloneOptions{
-			URL:           repo.Items.Url,
+			URL:           repo.Spec.Url,
 			Progress:      nil,
-			ReferenceName: plumbing.ReferenceName(repo.Items.Branch),
+			ReferenceName: plumbing.ReferenceName(repo.Spec.Ref.Branch),
 			SingleBranch:  true, // only fetch the desired ref, getting everything is unnecessary
 			Depth:         1,    // only fetch one commit, history is unnecessary
 
@@ -67,26 +72,40 @@ func ControllerGitRepository(client *api.Client) {
 		if err != nil {
 			logger.Error("failed to clone Git repository",
 				zap.String("gitRepository", repo.Path),
-				zap.String("url", repo.Items.Url),
+				zap.String("url", repo.Spec.Url),
 				zap.String("destination", base_path_plus_hash),
 				zap.Error(err),
 			)
+			repo.Status.Message = "failed to clone Git repository: " + err.Error()
+			repo.Status.Events = appendStatusEvent(repo.Status.Events, "SyncFailed", repo.Status.Message)
+			updateGitRepositoryStatusAfterSync(store, repo)
 			continue // If failed to clone, move on to the next repository.
 		}
-		current_revision, _ := repository.ResolveRevision(plumbing.Revision(string(repo.Items.Branch)))
+		current_revision, _ := repository.ResolveRevision(plumbing.Revision(string(repo.Spec.Ref.Branch)))
 		logger.Info("successfully cloned Git Repository",
 			zap.String("gitRepository", repo.Path),
 			zap.String("commit", current_revision.String()),
 		)
 
-		// Update the Nomad variable with status current commit (last refresh/modify time is stored as part of the variable itself)
-		repo.OriginalVariable.Items["status_current_commit"] = current_revision.String()
-		repo.OriginalVariable, _, err = client.Variables().Update(repo.OriginalVariable, &api.WriteOptions{})
-		if err != nil {
-			logger.Error("failed to update `status_current_commit` field back to Nomad Variables for GitRepository",
-				zap.String("gitRepository", repo.Path),
-				zap.Error(err),
-			)
+		// Update the status with the current commit
+		if repo.Status.CurrentCommit != current_revision.String() {
+			repo.Status.Events = appendStatusEvent(repo.Status.Events, "Synced", "synced commit "+current_revision.String())
 		}
+		repo.Status.CurrentCommit = current_revision.String()
+		repo.Status.Message = ""
+		updateGitRepositoryStatusAfterSync(store, repo)
+	}
+}
+
+// updateGitRepositoryStatusAfterSync records the outcome of a sync attempt, successful or not, in the object status
+func updateGitRepositoryStatusAfterSync(store ObjectStore, repo GitRepositoryObject) {
+	repo.Status.ObservedGeneration = repo.Generation
+	repo.Status.LastSyncTime = time.Now().Format(time.RFC3339)
+	err := UpdateGitRepositoryStatus(store, repo)
+	if err != nil {
+		logger.Error("failed to update status back to the object store for GitRepository",
+			zap.String("gitRepository", repo.Path),
+			zap.Error(err),
+		)
 	}
 }
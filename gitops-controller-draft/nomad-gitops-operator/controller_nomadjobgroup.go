@@ -1,160 +1,734 @@
 package main
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"time"
 
-	"github.com/hashicorp/hcl/v2/gohcl"
-	"github.com/hashicorp/hcl/v2/hclparse"
 	"github.com/hashicorp/nomad/api"
 	"go.uber.org/zap"
 )
 
-func ControllerNomadJobGroup(client *api.Client) {
+// The apply mode of a NomadJobGroup decides what happens when some of its job files fail:
+//   - `independent` (default): the other jobs are still registered, so the group may be partly on an older commit
+//   - `atomic`: every job is parsed, validated and planned first, and none are registered if any of these steps fail
+const (
+	APPLY_MODE_INDEPENDENT = "independent"
+	APPLY_MODE_ATOMIC      = "atomic"
+)
+
+func ControllerNomadJobGroup(client *api.Client, store ObjectStore) {
 	logger.Info("starting controller: NomadJobGroup")
 
-	nomad_jobs := FetchNomadJobGroupsForController(client)
-	git_repositories := FetchGitRepositoriesForController(client)
+	nomad_jobs := FetchNomadJobGroupsForController(store)
+	git_repositories := FetchGitRepositoriesForController(store)
 
-	// NomadJobGroups to more NomadJobGroups / First loop
+	// NomadJobGroups to more NomadJobGroups and GitRepositories / First loop
+	deleted_paths := map[string]bool{}
+	planned_object_changes := map[string][]ObjectChange{} // of groups that are a dry run
 	for _, job := range nomad_jobs {
 		repo, err := GetGitRepositoryForNomadJobGroup(job, &git_repositories)
 		if err != nil {
 			logger.Error("failed to reconcile NomadJobGroup due to missing repository",
-				zap.String("jobReferenceToGitRepository", job.Items.GitRepositoryName),
+				zap.String("jobReferenceToGitRepository", job.Spec.SourceRef),
 				zap.Error(err),
 			)
 			continue
 		}
-		base_path_plus_hash := GetPathForRepository(repo)
-		repo_job_path := filepath.Join(base_path_plus_hash, job.Items.NomadJobGroupRelativePath)
+		discovered := NewDiscoveredObjects()
+		job_groups_discovered := ApplyObjectDefinitionsFromRepository(store, job, repo, job.Spec.JobGroups, OBJECT_KIND_NOMAD_JOB_GROUP, discovered)
+		git_repositories_discovered := ApplyObjectDefinitionsFromRepository(store, job, repo, job.Spec.GitRepositories, OBJECT_KIND_GIT_REPOSITORY, discovered)
+
+		// Only garbage collect when the full list of definitions is known, e.g. not while the repository is missing
+		if job_groups_discovered && git_repositories_discovered {
+			for _, path := range GarbageCollectOwnedObjects(client, store, job, discovered) {
+				deleted_paths[path] = true
+			}
+		}
+		planned_object_changes[job.Path] = discovered.PlannedObjectChanges()
+	}
+	for _, path := range GarbageCollectOrphanedObjects(client, store) {
+		deleted_paths[path] = true
+	}
 
-		potential_files_to_apply, err := FilterFilePathsFromGivenDirectoryAndRegex(repo_job_path, job.Items.NomadJobGroupRegexPathFilter)
+	// NomadJobGroup to Nomad Jobs / Main loop - get the repo for this job, find the file(s), apply the jobs
+	// Groups are updated in place, so that the groups depending on them see their new status
+	ordered_jobs, dependency_cycles := OrderNomadJobGroupsByDependencies(nomad_jobs)
+	for _, job := range ordered_jobs {
+		if deleted_paths[job.Path] {
+			continue // garbage collected in the first loop
+		}
+		previous_jobs, previous_ready := job.Status.Jobs, job.Status.Ready
+		job.Status.Jobs = nil
+		job.Status.Ready = false
+		dry_run := IsDryRun(job.Spec)
+		if !dry_run {
+			job.Status.DryRunPlan = nil
+		}
+		var rendered_files map[string][]byte // job files rendered from a pack, nil if the group doesn't use one
+		repo, err := GetGitRepositoryForNomadJobGroup(*job, &git_repositories)
 		if err != nil {
-			logger.Error("failed to get or filter filepaths from input directory",
-				zap.String("directory", repo_job_path),
-				zap.String("gitRepository", repo.Path),
+			logger.Error("failed to reconcile NomadJobGroup due to missing repository",
+				zap.String("jobReferenceToGitRepository", job.Spec.SourceRef),
 				zap.Error(err),
 			)
+			job.Status.Message = err.Error()
+			job.Status.Events = appendStatusEvent(job.Status.Events, "ReconciliationFailed", job.Status.Message)
+			updateNomadJobGroupStatusAfterReconciliation(store, job)
 			continue
 		}
 
-		// Loop through list of files
-		for _, nomad_job_group_file_path := range potential_files_to_apply {
+		job.Status.BlockedReason = GetDependencyBlockedReason(job, ordered_jobs, dependency_cycles, &git_repositories)
+		if job.Status.BlockedReason != "" && !dry_run {
+			logger.Info("not reconciling NomadJobGroup until its dependencies are ready",
+				zap.String("nomadJobGroup", job.Path),
+				zap.String("reason", job.Status.BlockedReason),
+			)
+			job.Status.Events = appendStatusEvent(job.Status.Events, "DependenciesNotReady", job.Status.BlockedReason)
+			updateNomadJobGroupStatusAfterReconciliation(store, job)
+			continue
+		}
 
-			file_contents_bytes, err := os.ReadFile(filepath.Join(repo_job_path, nomad_job_group_file_path.Name()))
-			if err != nil {
-				logger.Error("failed to read file",
-					zap.String("fileName", nomad_job_group_file_path.Name()),
-					zap.Error(err),
-				)
-				continue // if we fail to read the file, skip it.
-			}
+		if !dry_run && job.Status.FailedCommit != "" && job.Status.FailedCommit == repo.Status.CurrentCommit && job.Status.ObservedGeneration == job.Generation {
+			// Re-registering would only fail and roll back again, so wait for a new commit or a change to the spec
+			logger.Info("not applying commit again, as its deployments failed",
+				zap.String("nomadJobGroup", job.Path),
+				zap.String("commit", repo.Status.CurrentCommit),
+			)
+			continue
+		}
 
-			// Parse bytes to internal HCL
-			variable_hcl, diagnostics := hclparse.NewParser().ParseHCL(file_contents_bytes, nomad_job_group_file_path.Name())
-			if diagnostics.HasErrors() {
-				logger.Error("failed to parse file as HCL Job",
-					zap.String("fileName", nomad_job_group_file_path.Name()),
-					zap.String("error", diagnostics.Error()),
-				)
-				continue // if we failed to parse, skip this file.
+		if until, overridden := takeSyncWindowOverride(job.Path); overridden {
+			job.Status.SyncWindowOverride = ""
+			if !until.IsZero() {
+				job.Status.SyncWindowOverride = until.Format(time.RFC3339)
 			}
-
-			// Parse internal HCL to something usable, decoding its contents to a NomadJobGroup object
-			var nomad_job_group_object NomadJobGroupObject
-			decodeDiags := gohcl.DecodeBody(variable_hcl.Body, nil, &nomad_job_group_object)
-			if decodeDiags.HasErrors() {
-				logger.Error("failed to decode NomadJobGroup HCL file",
-					zap.String("fileName", nomad_job_group_file_path.Name()),
-					zap.String("error", decodeDiags.Error()),
-				)
-				continue // if we failed to decode its contents, skip this file.
+		}
+		sync_windows, err := GetSyncWindowSchedules(job.Spec.SyncWindows)
+		if err != nil {
+			job.Status.Message = err.Error()
+			job.Status.Events = appendStatusEvent(job.Status.Events, "ReconciliationFailed", job.Status.Message)
+			updateNomadJobGroupStatusAfterReconciliation(store, job)
+			continue
+		}
+		now := time.Now()
+		override_until, _ := time.Parse(time.RFC3339, job.Status.SyncWindowOverride)
+		if now.After(override_until) {
+			job.Status.SyncWindowOverride = ""
+		}
+		job.Status.NextSyncWindow = ""
+		if !dry_run && !IsSyncAllowed(sync_windows, now) && job.Status.SyncWindowOverride == "" {
+			if repo.Status.CurrentCommit != job.Status.LastAppliedCommit {
+				job.Status.PendingCommit = repo.Status.CurrentCommit
+			}
+			if next_window := NextSyncWindow(sync_windows, now); !next_window.IsZero() {
+				job.Status.NextSyncWindow = next_window.Format(time.RFC3339)
+			}
+			logger.Info("not syncing NomadJobGroup outside of its sync windows",
+				zap.String("nomadJobGroup", job.Path),
+				zap.String("pendingCommit", job.Status.PendingCommit),
+				zap.String("nextSyncWindow", job.Status.NextSyncWindow),
+			)
+			// Nothing was applied, so the jobs are still as they were, e.g. ready for the groups depending on this one
+			job.Status.Jobs, job.Status.Ready = previous_jobs, previous_ready
+			job.Status.Message = "outside of sync windows, next window opens at " + job.Status.NextSyncWindow
+			if job.Status.PendingCommit != "" {
+				job.Status.Events = appendStatusEvent(job.Status.Events, "SyncWindowClosed",
+					fmt.Sprintf("commit %s is pending until the next sync window at %s", job.Status.PendingCommit, job.Status.NextSyncWindow))
 			}
+			updateNomadJobGroupStatusAfterReconciliation(store, job)
+			continue
+		}
+		job.Status.PendingCommit = ""
 
-			// Push/update the job spec to Nomad Variables
-			_, _, err = client.Variables().Create(nomad_job_group_object.ConvertToNomadVariable(), &api.WriteOptions{})
+		if job.Spec.ApplyMode != "" && job.Spec.ApplyMode != APPLY_MODE_INDEPENDENT && job.Spec.ApplyMode != APPLY_MODE_ATOMIC {
+			job.Status.Message = fmt.Sprintf("unknown apply_mode %q, expected %s or %s", job.Spec.ApplyMode, APPLY_MODE_INDEPENDENT, APPLY_MODE_ATOMIC)
+			job.Status.Events = appendStatusEvent(job.Status.Events, "ReconciliationFailed", job.Status.Message)
+			updateNomadJobGroupStatusAfterReconciliation(store, job)
+			continue
+		}
+		atomic := job.Spec.ApplyMode == APPLY_MODE_ATOMIC
+		deployment_timeout, err := GetDeploymentTimeout(job.Spec)
+		if err == nil {
+			err = ValidateCanaryAnalysis(job.Spec.CanaryAnalysis, deployment_timeout)
+		}
+		if err != nil {
+			job.Status.Message = err.Error()
+			job.Status.Events = appendStatusEvent(job.Status.Events, "ReconciliationFailed", job.Status.Message)
+			updateNomadJobGroupStatusAfterReconciliation(store, job)
+			continue
+		}
+
+		base_path_plus_hash := GetPathForRepository(repo)
+		if job.Spec.Pack != nil {
+			rendered_files, err = RenderPack(base_path_plus_hash, *job.Spec.Pack)
 			if err != nil {
-				logger.Error("failed to create NomadJobGroup variable",
+				logger.Error("failed to render pack",
+					zap.String("nomadJobGroup", job.Path),
+					zap.String("pack", job.Spec.Pack.Path),
 					zap.Error(err),
 				)
+				job.Status.Message = "failed to render pack: " + err.Error()
+				job.Status.Events = appendStatusEvent(job.Status.Events, "ReconciliationFailed", job.Status.Message)
+				updateNomadJobGroupStatusAfterReconciliation(store, job)
+				continue
 			}
-			logger.Info("successfully created/updated NomadJobGroup variable",
-				zap.String("nomadJobGroup", nomad_job_group_object.Path),
+		}
+		potential_files_to_apply, err := selectJobFiles(base_path_plus_hash, job.Spec.Jobs, rendered_files)
+		if err != nil {
+			logger.Error("failed to get or filter filepaths from input directory",
+				zap.String("directory", filepath.Join(base_path_plus_hash, job.Spec.Jobs.Path)),
+				zap.String("gitRepository", repo.Path),
+				zap.Error(err),
 			)
+			job.Status.Message = "failed to get or filter filepaths from input directory: " + err.Error()
+			job.Status.Events = appendStatusEvent(job.Status.Events, "ReconciliationFailed", job.Status.Message)
+			updateNomadJobGroupStatusAfterReconciliation(store, job)
+			continue
 		}
-	}
-
-	// NomadJobGroup to Nomad Jobs / Main loop - get the repo for this job, find the file(s), apply the jobs
-	for _, job := range nomad_jobs {
-		repo, err := GetGitRepositoryForNomadJobGroup(job, &git_repositories)
+		job.Status.SelectedFiles = potential_files_to_apply
+		substitution_values, err := LoadSubstitutionValues(client, job.Namespace, job.Spec.Substitution)
 		if err != nil {
-			logger.Error("failed to reconcile NomadJobGroup due to missing repository",
-				zap.String("jobReferenceToGitRepository", job.Items.GitRepositoryName),
+			logger.Error("failed to load substitution values",
+				zap.String("nomadJobGroup", job.Path),
 				zap.Error(err),
 			)
+			job.Status.Message = err.Error()
+			job.Status.Events = appendStatusEvent(job.Status.Events, "ReconciliationFailed", job.Status.Message)
+			updateNomadJobGroupStatusAfterReconciliation(store, job)
+			continue
 		}
-
-		base_path_plus_hash := GetPathForRepository(repo)
-		repo_job_path := filepath.Join(base_path_plus_hash, job.Items.NomadJobRelativePath)
-
-		potential_files_to_apply, err := FilterFilePathsFromGivenDirectoryAndRegex(repo_job_path, job.Items.NomadJobRegexPathFilter)
+		job_patches, err := LoadJobPatches(base_path_plus_hash, job.Spec.Patches)
 		if err != nil {
-			logger.Error("failed to get or filter filepaths from input directory",
-				zap.String("directory", repo_job_path),
-				zap.String("gitRepository", repo.Path),
+			// Registering the jobs without their patches could e.g. deploy development settings to production
+			logger.Error("failed to load patch files",
+				zap.String("nomadJobGroup", job.Path),
 				zap.Error(err),
 			)
+			job.Status.Message = "failed to load patch files: " + err.Error()
+			job.Status.Events = appendStatusEvent(job.Status.Events, "ReconciliationFailed", job.Status.Message)
+			updateNomadJobGroupStatusAfterReconciliation(store, job)
+			continue
 		}
+		job_variables, variable_errors := LoadJobVariables(base_path_plus_hash, job.Spec)
+		job.Status.Jobs = append(job.Status.Jobs, variable_errors...)
 
-		// Go through the job files, parse the HCL and add to next list if valid
+		// Go through the job files, parse the HCL or JSON and add to next list if valid
 		hcl_job_specs := []*api.Job{}
+		hcl_job_statuses := []*NomadJobStatus{}
 		for _, job_spec_file := range potential_files_to_apply {
-			file_contents_bytes, err := os.ReadFile(filepath.Join(repo_job_path, job_spec_file.Name()))
+			file_contents_bytes, is_rendered := rendered_files[job_spec_file]
+			if !is_rendered {
+				file_contents_bytes, err = os.ReadFile(filepath.Join(base_path_plus_hash, job_spec_file))
+			}
 			if err != nil {
 				logger.Error("failed to read file",
-					zap.String("fileName", job_spec_file.Name()),
+					zap.String("fileName", job_spec_file),
 					zap.Error(err),
 				)
+				job.Status.Jobs = append(job.Status.Jobs, NomadJobStatus{FileName: job_spec_file, Error: err.Error()})
+				continue
 			}
-			job_hcl, err := client.Jobs().ParseHCL(string(file_contents_bytes), true)
+			if !job.Spec.Substitution.IsEmpty() {
+				substituted, err := SubstituteVariables(string(file_contents_bytes), substitution_values, job.Spec.Substitution.Strict)
+				if err != nil {
+					logger.Error("failed to substitute placeholders in Job specification",
+						zap.String("fileName", job_spec_file),
+						zap.Error(err),
+					)
+					job.Status.Jobs = append(job.Status.Jobs, NomadJobStatus{FileName: job_spec_file, Error: err.Error()})
+					continue
+				}
+				file_contents_bytes = []byte(substituted)
+			}
+			job_hcl, err := ParseJobFile(client, base_path_plus_hash, repo.Status.CurrentCommit, job_spec_file, file_contents_bytes, job_variables)
 			if err != nil {
-				logger.Error("failed to parse file as HCL Job",
-					zap.String("fileName", job_spec_file.Name()),
+				logger.Error("failed to parse file as Job",
+					zap.String("fileName", job_spec_file),
 					zap.Error(err),
 				)
+				job.Status.Jobs = append(job.Status.Jobs, NomadJobStatus{FileName: job_spec_file, Error: err.Error(), Diagnostics: JobDiagnosticsFromError(err)})
 				continue
 			}
 			logger.Info("successfully parsed Job specification",
-				zap.String("fileName", job_spec_file.Name()),
+				zap.String("fileName", job_spec_file),
 			)
 
+			job_patches.Apply(job_hcl)
+
 			// Add meta information to each Job
 			job_hcl.SetMeta("nomad_gitops_managed", "true")
-			job_hcl.SetMeta("nomad_gitops_current_commit", repo.Items.StatusCurrentCommit)
-			job_hcl.SetMeta("nomad_gitops_last_reconciliation_timestamp", time.Now().Format(time.RFC3339))
+			job_hcl.SetMeta("nomad_gitops_current_commit", repo.Status.CurrentCommit)
 			job_hcl.SetMeta("nomad_gitops_nomad_job_group", job.Path)
 			job_hcl.SetMeta("nomad_gitops_git_repository", repo.Path)
 			job_hcl.SetMeta("nomad_gitops_controller_name", controller_name)
 			job_hcl.SetMeta("nomad_gitops_controller_namespace", controller_namespace)
 
+			diagnostics, err := ValidateJob(client, job_hcl)
+			if err != nil {
+				logger.Error("failed to validate job",
+					zap.String("fileName", job_spec_file),
+					zap.Error(err),
+				)
+				job.Status.Jobs = append(job.Status.Jobs, NomadJobStatus{FileName: job_spec_file, JobName: *job_hcl.Name, Error: err.Error()})
+				continue
+			}
+			if message, is_invalid := firstErrorDiagnostic(diagnostics); is_invalid {
+				logger.Error("job failed validation",
+					zap.String("fileName", job_spec_file),
+					zap.String("error", message),
+				)
+				job.Status.Jobs = append(job.Status.Jobs, NomadJobStatus{FileName: job_spec_file, JobName: *job_hcl.Name, Error: "job is invalid: " + message, Diagnostics: diagnostics})
+				continue
+			}
+
 			hcl_job_specs = append(hcl_job_specs, job_hcl)
+			hcl_job_statuses = append(hcl_job_statuses, &NomadJobStatus{FileName: job_spec_file, JobName: *job_hcl.Name, Diagnostics: diagnostics})
+		}
+
+		job.Status.Jobs = append(job.Status.Jobs, job_variables.Unused()...)
+		job.Status.Jobs = append(job.Status.Jobs, job_patches.Unmatched()...)
+
+		// Plan every job, so that jobs without changes are not registered again, which would create a new evaluation each run
+		invalid_files := countFailedJobStatuses(job.Status.Jobs)
+		unchanged_jobs := make([]bool, len(hcl_job_specs))
+		job_plans := make([]*api.JobPlanResponse, len(hcl_job_specs))
+		preserve_counts := make([]bool, len(hcl_job_specs))
+		hook_job_hashes := make([]string, len(hcl_job_specs))
+		for i, job_spec := range hcl_job_specs {
+			if isHookJob(job_spec) {
+				hook_job_hashes[i] = hookJobHash(job_spec)
+			}
+			preserve_counts[i], err = ApplyIgnoreRules(client, job_spec, job.Spec.IgnoreDifferences)
+			if err != nil {
+				logger.Error("failed to read registered job for ignore rules",
+					zap.String("jobName", *job_spec.Name),
+					zap.Error(err),
+				)
+				hcl_job_statuses[i].Error = "failed to read registered job for ignore rules: " + err.Error()
+				invalid_files++
+				continue
+			}
+			plan_result, _, err := client.Jobs().Plan(job_spec, true, nil)
+			if err != nil {
+				logger.Error("failed to plan job",
+					zap.String("jobName", *job_spec.Name),
+					zap.Error(err),
+				)
+				hcl_job_statuses[i].Error = "failed to plan job: " + err.Error()
+				invalid_files++
+				continue
+			}
+			unchanged_jobs[i] = plan_result.Diff != nil && plan_result.Diff.Type == "None"
+			if _, completed := CompletedHookRun(job.Status.HookRuns, job_spec, hook_job_hashes[i]); completed {
+				unchanged_jobs[i] = true // even once Nomad garbage collected the hook job and plans to add it again
+			}
+			job_plans[i] = plan_result
+		}
+
+		sync_stages, stage_errors := GetSyncStages(hcl_job_specs)
+		for i, err := range stage_errors {
+			if hcl_job_statuses[i].Error == "" {
+				hcl_job_statuses[i].Error = err.Error()
+				invalid_files++
+			}
+		}
+		if dry_run {
+			job.Status.DryRunPlan = NewPlanResult(repo.Status.CurrentCommit, hcl_job_statuses, job_plans)
+			job.Status.DryRunPlan.Objects = planned_object_changes[job.Path]
+			changed_jobs := 0
+			for i := range hcl_job_specs {
+				if job_plans[i] != nil && !unchanged_jobs[i] {
+					changed_jobs++
+				}
+			}
+			logger.Info("planned NomadJobGroup without registering its jobs, as it is a dry run",
+				zap.String("nomadJobGroup", job.Path),
+				zap.Int("changedJobs", changed_jobs),
+			)
+			for _, job_status := range hcl_job_statuses {
+				job.Status.Jobs = append(job.Status.Jobs, *job_status)
+			}
+			job.Status.Message = fmt.Sprintf("dry run: %d jobs would change at commit %s", changed_jobs, repo.Status.CurrentCommit)
+			job.Status.Events = appendStatusEvent(job.Status.Events, "DryRun", job.Status.Message)
+			updateNomadJobGroupStatusAfterReconciliation(store, job)
+			continue
+		}
+
+		if (job.Spec.BlockOnInvalid || atomic) && invalid_files > 0 {
+			// Registering only the valid jobs could leave the group half-updated, e.g. a service without its database
+			logger.Error("not registering any jobs, as some job files of the group are invalid",
+				zap.String("nomadJobGroup", job.Path),
+				zap.Int("invalidFiles", invalid_files),
+			)
+			for _, job_status := range hcl_job_statuses {
+				job.Status.Jobs = append(job.Status.Jobs, *job_status)
+			}
+			job.Status.Message = fmt.Sprintf("apply blocked at commit %s, as job files are invalid", repo.Status.CurrentCommit)
+			job.Status.Events = appendStatusEvent(job.Status.Events, "ApplyBlocked", job.Status.Message)
+			updateNomadJobGroupStatusAfterReconciliation(store, job)
+			continue
 		}
 
-		// Go through HCL job specs, register each job
-		for _, job_spec := range hcl_job_specs {
-			register_result, _, err := client.Jobs().Register(job_spec, &api.WriteOptions{})
+		// Hold new commits until they are approved, showing what applying them would change
+		if job.Spec.ApprovalRequired && job.Status.ApprovedCommit != repo.Status.CurrentCommit {
+			approval, err := ReadApproval(store, job.Path)
 			if err != nil {
-				logger.Error("failed to register job",
+				logger.Error("failed to read approval of NomadJobGroup",
+					zap.String("nomadJobGroup", job.Path),
+					zap.Error(err),
+				)
+			}
+			if approval != nil && approval.Commit == repo.Status.CurrentCommit {
+				logger.Info("commit approved, applying it",
+					zap.String("nomadJobGroup", job.Path),
+					zap.String("commit", approval.Commit),
+					zap.String("approvedBy", approval.ApprovedBy),
+				)
+				job.Status.ApprovedCommit = approval.Commit
+				job.Status.Approvals = appendApprovalRecord(job.Status.Approvals, *approval)
+				job.Status.AwaitingApproval = nil
+				job.Status.Events = appendStatusEvent(job.Status.Events, "Approved",
+					fmt.Sprintf("commit %s approved by %s", approval.Commit, approval.ApprovedBy))
+			} else {
+				awaiting := &PendingApproval{Commit: repo.Status.CurrentCommit, Since: time.Now().Format(time.RFC3339)}
+				newly_awaiting := job.Status.AwaitingApproval == nil || job.Status.AwaitingApproval.Commit != awaiting.Commit
+				if !newly_awaiting {
+					awaiting.Since = job.Status.AwaitingApproval.Since
+				}
+				awaiting.Plan = NewPlanResult(awaiting.Commit, hcl_job_statuses, job_plans).Jobs
+				job.Status.AwaitingApproval = awaiting
+				if newly_awaiting && approval != nil && approval.Commit != job.Status.ApprovedCommit {
+					// Only once per commit, as the events would otherwise alternate with AwaitingApproval every run
+					job.Status.Events = appendStatusEvent(job.Status.Events, "ApprovalExpired",
+						fmt.Sprintf("approval of commit %s by %s was superseded by commit %s", approval.Commit, approval.ApprovedBy, awaiting.Commit))
+				}
+				for _, job_status := range hcl_job_statuses {
+					job.Status.Jobs = append(job.Status.Jobs, *job_status)
+				}
+				job.Status.Message = "awaiting approval of commit " + awaiting.Commit
+				job.Status.Events = appendStatusEvent(job.Status.Events, "AwaitingApproval", job.Status.Message)
+				updateNomadJobGroupStatusAfterReconciliation(store, job)
+				continue
+			}
+		}
+
+		// Keep the runs of the hooks that are still part of the group
+		hook_runs := map[string]HookRun{}
+		for i, job_spec := range hcl_job_specs {
+			if run, exists := job.Status.HookRuns[*job_spec.ID]; exists && hook_job_hashes[i] != "" {
+				hook_runs[*job_spec.ID] = run
+			}
+		}
+		job.Status.HookRuns = hook_runs
+
+		// Register the jobs stage by stage, see sync_waves.go, checking once on their deployments. Stages after one that is
+		// still in progress are registered on a later run, and those after one that failed are not registered.
+		register_failed := false
+		failed_stage, waiting_for_stage := "", ""
+		in_progress := 0
+		for _, stage := range sync_stages {
+			if failed_stage != "" {
+				for _, i := range stage.Jobs {
+					if hcl_job_statuses[i].Error == "" {
+						hcl_job_statuses[i].Error = "not registered, as " + failed_stage + " failed"
+					}
+				}
+				continue
+			}
+
+			waiting := map[int]bool{}
+			for _, i := range stage.Jobs {
+				job_spec := hcl_job_specs[i]
+				if hcl_job_statuses[i].Error != "" {
+					continue // failed to plan
+				}
+				if atomic && register_failed {
+					hcl_job_statuses[i].Error = "not registered, as registering an earlier job of the group failed"
+					continue
+				}
+				if unchanged_jobs[i] {
+					logger.Debug("job is unchanged, not registering it again",
+						zap.String("jobName", *job_spec.Name),
+					)
+					trackPreviousDeployment(hcl_job_statuses[i], previous_jobs)
+					continue
+				}
+				if waiting_for_stage != "" {
+					hcl_job_statuses[i].Warning = "not registered yet, waiting for " + waiting_for_stage + " to finish"
+					waiting[i] = true
+					continue
+				}
+				register_options := &api.RegisterOptions{PreserveCounts: preserve_counts[i]} // in case counts changed since planning
+				register_result, _, err := client.Jobs().RegisterOpts(job_spec, register_options, &api.WriteOptions{})
+				if err != nil {
+					logger.Error("failed to register job",
+						zap.String("jobName", *job_spec.Name),
+						zap.Error(err),
+					)
+					hcl_job_statuses[i].Error = err.Error()
+					register_failed = true
+					continue
+				}
+				logger.Info("registered job successfully",
 					zap.String("jobName", *job_spec.Name),
+					zap.String("evalId", register_result.EvalID),
+				)
+				hcl_job_statuses[i].EvalId = register_result.EvalID
+				if isHookJob(job_spec) {
+					job.Status.HookRuns[*job_spec.ID] = HookRun{Commit: repo.Status.CurrentCommit, JobHash: hook_job_hashes[i], Status: HOOK_RUN_STATUS_RUNNING}
+				}
+			}
+
+			for _, i := range stage.Jobs {
+				job_spec := hcl_job_specs[i]
+				if hcl_job_statuses[i].Error != "" || waiting[i] {
+					continue
+				}
+				var deployment *JobDeploymentStatus
+				tracked := hcl_job_statuses[i].Deployment
+				if run, completed := CompletedHookRun(job.Status.HookRuns, job_spec, hook_job_hashes[i]); completed {
+					deployment = run.DeploymentStatus()
+				} else if isHookJob(job_spec) {
+					deployment, err = CheckHookJob(client, job_spec, hcl_job_statuses[i].EvalId, tracked, deployment_timeout)
+					if err == nil && deployment.Healthy() {
+						job.Status.HookRuns[*job_spec.ID] = NewHookRun(repo.Status.CurrentCommit, hook_job_hashes[i], deployment)
+					}
+				} else {
+					deployment, err = CheckDeployment(client, job_spec, hcl_job_statuses[i].EvalId, tracked, deployment_timeout, job.Spec.CanaryAnalysis)
+				}
+				if err != nil {
+					logger.Error("failed to follow deployment of job",
+						zap.String("jobName", *job_spec.Name),
+						zap.Error(err),
+					)
+					hcl_job_statuses[i].Error = "failed to follow deployment: " + err.Error()
+					continue
+				}
+				hcl_job_statuses[i].Deployment = deployment
+				if deployment.InProgress() {
+					logger.Debug("deployment of job is in progress",
+						zap.String("jobName", *job_spec.Name),
+						zap.String("deploymentId", deployment.ID),
+						zap.String("deploymentStatus", deployment.Status),
+					)
+					in_progress++
+					if len(sync_stages) > 1 && waiting_for_stage == "" {
+						waiting_for_stage = stage.Name
+					}
+					continue
+				}
+				if !deployment.Healthy() {
+					logger.Error("deployment of job did not succeed",
+						zap.String("jobName", *job_spec.Name),
+						zap.String("deploymentId", deployment.ID),
+						zap.String("deploymentStatus", deployment.Status),
+						zap.String("description", deployment.Description),
+					)
+					hcl_job_statuses[i].Error = fmt.Sprintf("deployment %s: %s", deployment.Status, deployment.Description)
+					continue
+				}
+				if tracked == nil || !tracked.Healthy() {
+					logger.Info("deployment of job is healthy",
+						zap.String("jobName", *job_spec.Name),
+						zap.String("deploymentId", deployment.ID),
+					)
+				}
+			}
+
+			for _, i := range stage.Jobs {
+				if hcl_job_statuses[i].Error != "" && len(sync_stages) > 1 {
+					failed_stage = stage.Name
+				}
+			}
+		}
+
+		// Revert the jobs whose tracked deployments failed, and mark the commit as failed so it is not re-applied every run
+		if job.Spec.RollbackOnFailure {
+			for i, job_spec := range hcl_job_specs {
+				if !ShouldRollBack(hcl_job_statuses[i], job_spec) {
+					continue
+				}
+				job.Status.FailedCommit = repo.Status.CurrentCommit
+				version, err := RevertToLastStableVersion(client, job_spec)
+				if err != nil {
+					logger.Error("failed to roll back job",
+						zap.String("jobName", *job_spec.Name),
+						zap.Error(err),
+					)
+					hcl_job_statuses[i].Error += "; failed to roll back: " + err.Error()
+					continue
+				}
+				logger.Info("rolled back job to its last stable version",
+					zap.String("jobName", *job_spec.Name),
+					zap.Uint64("version", version),
+				)
+				hcl_job_statuses[i].Error += fmt.Sprintf("; rolled back to version %d", version)
+			}
+			if job.Status.FailedCommit == repo.Status.CurrentCommit {
+				job.Status.Events = appendStatusEvent(job.Status.Events, "RolledBack",
+					fmt.Sprintf("deployments failed at commit %s, not applying it again until a new commit", repo.Status.CurrentCommit))
+			}
+		}
+
+		failed_jobs := countFailedJobStatuses(job.Status.Jobs) // files that failed to be read or parsed, and variable errors
+		for _, job_status := range hcl_job_statuses {
+			job.Status.Jobs = append(job.Status.Jobs, *job_status)
+			if job_status.Error != "" {
+				failed_jobs++
+			}
+		}
+
+		job.Status.Message = ""
+		if failed_jobs > 0 {
+			job.Status.Events = appendStatusEvent(job.Status.Events, "JobsFailed",
+				fmt.Sprintf("%d of %d job files failed at commit %s", failed_jobs, len(job.Status.Jobs), repo.Status.CurrentCommit))
+		} else if in_progress > 0 {
+			// Not Ready until the deployments finished, which the next runs check on
+			job.Status.Message = fmt.Sprintf("waiting for %d deployments at commit %s", in_progress, repo.Status.CurrentCommit)
+		} else {
+			if job.Status.ConvergedCommit != repo.Status.CurrentCommit {
+				job.Status.Events = appendStatusEvent(job.Status.Events, "Applied", "applied commit "+repo.Status.CurrentCommit)
+			}
+			job.Status.ConvergedCommit = repo.Status.CurrentCommit
+			job.Status.FailedCommit = ""
+			job.Status.Ready = true
+		}
+		job.Status.LastAppliedCommit = repo.Status.CurrentCommit
+		updateNomadJobGroupStatusAfterReconciliation(store, job)
+	}
+}
+
+// trackPreviousDeployment keeps following the evaluation and deployment recorded for an unchanged job on earlier runs
+func trackPreviousDeployment(job_status *NomadJobStatus, previous_jobs []NomadJobStatus) {
+	for _, previous := range previous_jobs {
+		if previous.FileName == job_status.FileName && previous.JobName == job_status.JobName {
+			job_status.EvalId, job_status.Deployment = previous.EvalId, previous.Deployment
+			return
+		}
+	}
+}
+
+// countFailedJobStatuses counts the statuses with an error, as opposed to those that only have a warning
+func countFailedJobStatuses(statuses []NomadJobStatus) (failed int) {
+	for _, status := range statuses {
+		if status.Error != "" {
+			failed++
+		}
+	}
+	return
+}
+
+// selectJobFiles returns the job files of a NomadJobGroup, either those rendered from its pack or those selected by `jobs`
+func selectJobFiles(repo_root string, selector FileSelector, rendered_files map[string][]byte) ([]string, error) {
+	if rendered_files == nil {
+		return SelectFilesFromRepository(repo_root, selector)
+	}
+	file_names := []string{}
+	for file_name := range rendered_files {
+		file_names = append(file_names, file_name)
+	}
+	sort.Strings(file_names)
+	return file_names, nil
+}
+
+// updateNomadJobGroupStatusAfterReconciliation records the outcome of a reconciliation, successful or not, in the object status
+func updateNomadJobGroupStatusAfterReconciliation(store ObjectStore, job *NomadJobGroupObject) {
+	job.Status.ObservedGeneration = job.Generation
+	job.Status.LastReconciliationTime = time.Now().Format(time.RFC3339)
+	err := UpdateNomadJobGroupStatus(store, *job)
+	if err != nil {
+		logger.Error("failed to update status back to the object store for NomadJobGroup",
+			zap.String("nomadJobGroup", job.Path),
+			zap.Error(err),
+		)
+	}
+}
+
+// ApplyObjectDefinitionsFromRepository pushes the objects of the given kind defined in the selected files to the object store,
+// owned by the given NomadJobGroup. Returns false if the files could not be listed, i.e. nothing was discovered.
+func ApplyObjectDefinitionsFromRepository(store ObjectStore, job NomadJobGroupObject, repo GitRepositoryObject, selector FileSelector, kind string, discovered DiscoveredObjects) bool {
+	if selector.IsEmpty() {
+		return true // nothing to discover for this kind
+	}
+	base_path_plus_hash := GetPathForRepository(repo)
+	potential_files_to_apply, err := SelectFilesFromRepository(base_path_plus_hash, selector)
+	if err != nil {
+		logger.Error("failed to get or filter filepaths from input directory",
+			zap.String("directory", filepath.Join(base_path_plus_hash, selector.Path)),
+			zap.String("gitRepository", repo.Path),
+			zap.Error(err),
+		)
+		return false
+	}
+
+	// Loop through list of files
+	for _, source_file := range potential_files_to_apply {
+		file_contents_bytes, err := os.ReadFile(filepath.Join(base_path_plus_hash, source_file))
+		if err != nil {
+			logger.Error("failed to read file",
+				zap.String("fileName", source_file),
+				zap.Error(err),
+			)
+			discovered.FailedSourceFiles[source_file] = true
+			continue // if we fail to read the file, skip it.
+		}
+
+		// Parse the HCL file, decoding its contents to an object definition
+		object_file, err := ParseObjectFile(file_contents_bytes, source_file)
+		if err != nil {
+			logger.Error(fmt.Sprintf("failed to parse %s HCL file", kind),
+				zap.String("fileName", source_file),
+				zap.Error(err),
+			)
+			discovered.FailedSourceFiles[source_file] = true
+			continue // if we failed to parse or decode, skip this file.
+		}
+
+		// Make sure the file holds a valid object of the expected kind before storing it
+		object := object_file.ConvertToStoredObject()
+		switch kind {
+		case OBJECT_KIND_NOMAD_JOB_GROUP:
+			_, err = decodeStoredObject(*object, kind, &NomadJobGroupSpec{}, &NomadJobGroupStatus{})
+		case OBJECT_KIND_GIT_REPOSITORY:
+			_, err = decodeStoredObject(*object, kind, &GitRepositorySpec{}, &GitRepositoryStatus{})
+		}
+		if err != nil {
+			logger.Error(fmt.Sprintf("file does not contain a valid %s", kind),
+				zap.String("fileName", source_file),
+				zap.Error(err),
+			)
+			discovered.FailedSourceFiles[source_file] = true
+			continue
+		}
+
+		// Push/update the object to the object store, or only record the change if the group is a dry run
+		discovered.Paths[object.Path] = true
+		if IsDryRun(job.Spec) {
+			change, err := prepareGeneratedObject(store, object, job.Path, source_file)
+			if err != nil {
+				logger.Error(fmt.Sprintf("failed to plan %s object", kind),
+					zap.String("variablePath", object.Path),
 					zap.Error(err),
 				)
+			} else if change != "" {
+				discovered.PlannedChanges[object.Path] = ObjectChange{Path: object.Path, Kind: kind, Change: change, SourceFile: source_file}
 			}
-			logger.Info("registered job successfully",
-				zap.String("jobName", *job_spec.Name),
-				zap.String("evalId", register_result.EvalID),
+			continue
+		}
+		err = ApplyGeneratedObject(store, object, job.Path, source_file)
+		if err != nil {
+			logger.Error(fmt.Sprintf("failed to create %s object", kind),
+				zap.String("variablePath", object.Path),
+				zap.Error(err),
 			)
+			continue
 		}
+		logger.Info(fmt.Sprintf("successfully created/updated %s object", kind),
+			zap.String("variablePath", object.Path),
+		)
 	}
+	return true
 }
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Objects are always handled as the latest schema version (v2) inside the controller.
+// Older versions are converted up when read, and converted back down when written in their original version,
+// so objects are only rewritten to a newer version explicitly, through the `migrate` command.
+
+// v1 specs, frozen - do not add fields here, add them to the v2 structs in data_structures.go instead
+
+type GitRepositorySpecV1 struct {
+	Url    string `json:"url"`
+	Type   string `json:"type"`
+	Branch string `json:"branch"`
+}
+
+type NomadJobGroupSpecV1 struct {
+	GitRepositoryName            string `json:"git_repository_name"`
+	NomadJobRelativePath         string `json:"nomad_job_relative_path"`
+	NomadJobRegexPathFilter      string `json:"nomad_job_regex_path_filter"`
+	NomadJobGroupRelativePath    string `json:"nomad_job_group_relative_path"`
+	NomadJobGroupRegexPathFilter string `json:"nomad_job_group_regex_path_filter"`
+}
+
+// Objects written before the schema was versioned hold their fields as flat items next to `controller_name`, without
+// `api_version`, `kind` or a `spec` document, and the commit of a GitRepository as `status_current_commit`. They are
+// read as v1 specs, with their kind taken from their path, and rewritten as v2 objects by the `migrate` command.
+
+const OBJECT_API_VERSION_FLAT = "" // objects in the flat format have no api_version
+
+type GitRepositoryItemsFlat struct {
+	ControllerName      string `hcl:"controller_name"`
+	Url                 string `hcl:"url"`
+	Type                string `hcl:"type"`
+	Branch              string `hcl:"branch"`
+	StatusCurrentCommit string `hcl:"status_current_commit,optional"`
+
+	// Written by the controller since the schema was versioned
+	Generation string `hcl:"generation,optional"`
+	SpecHash   string `hcl:"spec_hash,optional"`
+	Status     string `hcl:"status,optional"`
+}
+
+type NomadJobGroupItemsFlat struct {
+	ControllerName               string `hcl:"controller_name"`
+	GitRepositoryName            string `hcl:"git_repository_name"`
+	NomadJobRelativePath         string `hcl:"nomad_job_relative_path"`
+	NomadJobRegexPathFilter      string `hcl:"nomad_job_regex_path_filter"`
+	NomadJobGroupRelativePath    string `hcl:"nomad_job_group_relative_path"`
+	NomadJobGroupRegexPathFilter string `hcl:"nomad_job_group_regex_path_filter"`
+	Spec                         string `hcl:"spec,optional"` // a placeholder in the flat format, not used
+
+	// Written by the controller since the schema was versioned, `status` was a placeholder before
+	Generation string `hcl:"generation,optional"`
+	SpecHash   string `hcl:"spec_hash,optional"`
+	Status     string `hcl:"status,optional"`
+}
+
+// Conversion functions
+
+func (spec GitRepositorySpecV1) ConvertToV2() GitRepositorySpec {
+	return GitRepositorySpec{
+		Url:  spec.Url,
+		Type: spec.Type,
+		Ref:  GitReference{Branch: spec.Branch},
+	}
+}
+
+func (spec GitRepositorySpec) ConvertToV1() GitRepositorySpecV1 {
+	return GitRepositorySpecV1{
+		Url:    spec.Url,
+		Type:   spec.Type,
+		Branch: spec.Ref.Branch,
+	}
+}
+
+func (spec NomadJobGroupSpecV1) ConvertToV2() NomadJobGroupSpec {
+	return NomadJobGroupSpec{
+		SourceRef: spec.GitRepositoryName,
+		Jobs: FileSelector{
+			Path:        spec.NomadJobRelativePath,
+			RegexFilter: spec.NomadJobRegexPathFilter,
+		},
+		JobGroups: FileSelector{
+			Path:        spec.NomadJobGroupRelativePath,
+			RegexFilter: spec.NomadJobGroupRegexPathFilter,
+		},
+	}
+}
+
+func (spec NomadJobGroupSpec) ConvertToV1() NomadJobGroupSpecV1 {
+	return NomadJobGroupSpecV1{
+		GitRepositoryName:            spec.SourceRef,
+		NomadJobRelativePath:         spec.Jobs.Path,
+		NomadJobRegexPathFilter:      spec.Jobs.RegexFilter,
+		NomadJobGroupRelativePath:    spec.JobGroups.Path,
+		NomadJobGroupRegexPathFilter: spec.JobGroups.RegexFilter,
+	}
+}
+
+// decodeSpecDocument decodes a `spec` document stored in the given api_version into its v2 struct
+func decodeSpecDocument(api_version string, document string, spec interface{}) error {
+	switch api_version {
+	case OBJECT_API_VERSION_V2:
+		return json.Unmarshal([]byte(document), spec)
+	case OBJECT_API_VERSION_V1:
+		switch spec_v2 := spec.(type) {
+		case *GitRepositorySpec:
+			spec_v1 := GitRepositorySpecV1{}
+			if err := json.Unmarshal([]byte(document), &spec_v1); err != nil {
+				return err
+			}
+			*spec_v2 = spec_v1.ConvertToV2()
+			return nil
+		case *NomadJobGroupSpec:
+			spec_v1 := NomadJobGroupSpecV1{}
+			if err := json.Unmarshal([]byte(document), &spec_v1); err != nil {
+				return err
+			}
+			*spec_v2 = spec_v1.ConvertToV2()
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported api_version %q", api_version)
+}
+
+// encodeSpecDocument encodes a v2 spec as a `spec` document in the given api_version
+func encodeSpecDocument(api_version string, spec interface{}) string {
+	if api_version == OBJECT_API_VERSION_V1 {
+		switch spec_v2 := spec.(type) {
+		case GitRepositorySpec:
+			return mustMarshalJSON(spec_v2.ConvertToV1())
+		case NomadJobGroupSpec:
+			return mustMarshalJSON(spec_v2.ConvertToV1())
+		}
+	}
+	return mustMarshalJSON(spec)
+}
+
+// IsFlatObject checks whether a stored object is in the flat format that predates `api_version`
+func IsFlatObject(object StoredObject) bool {
+	return object.Items["api_version"] == "" && object.Items["kind"] == ""
+}
+
+// getKindFromPath returns the kind of object stored at a path, for objects that do not record their kind
+func getKindFromPath(path string) string {
+	for _, prefix := range NOMAD_VAR_GITREPOSITORY_PREFIXES {
+		if strings.HasPrefix(path, prefix) {
+			return OBJECT_KIND_GIT_REPOSITORY
+		}
+	}
+	for _, prefix := range NOMAD_VAR_NOMADJOB_PREFIXES {
+		if strings.HasPrefix(path, prefix) {
+			return OBJECT_KIND_NOMAD_JOB_GROUP
+		}
+	}
+	return ""
+}
+
+// decodeFlatObject decodes an object in the flat format into its v2 spec and status
+func decodeFlatObject(object StoredObject, expected_kind string, spec interface{}, status interface{}) (meta ObjectMeta, err error) {
+	kind := getKindFromPath(object.Path)
+	if kind != expected_kind {
+		return meta, fmt.Errorf("expected kind %q, got %q from the path of an object without kind", expected_kind, kind)
+	}
+
+	var controller_name, generation_item, status_item string
+	switch spec_v2 := spec.(type) {
+	case *GitRepositorySpec:
+		items := GitRepositoryItemsFlat{}
+		err = getMapStructureDecoder(&items).Decode(object.Items)
+		if err != nil {
+			return
+		}
+		*spec_v2 = GitRepositorySpecV1{Url: items.Url, Type: items.Type, Branch: items.Branch}.ConvertToV2()
+		controller_name, generation_item, status_item = items.ControllerName, items.Generation, items.Status
+		if repo_status, is_repo_status := status.(*GitRepositoryStatus); is_repo_status && status_item == "" {
+			repo_status.CurrentCommit = items.StatusCurrentCommit
+		}
+	case *NomadJobGroupSpec:
+		items := NomadJobGroupItemsFlat{}
+		err = getMapStructureDecoder(&items).Decode(object.Items)
+		if err != nil {
+			return
+		}
+		*spec_v2 = NomadJobGroupSpecV1{
+			GitRepositoryName:            items.GitRepositoryName,
+			NomadJobRelativePath:         items.NomadJobRelativePath,
+			NomadJobRegexPathFilter:      items.NomadJobRegexPathFilter,
+			NomadJobGroupRelativePath:    items.NomadJobGroupRelativePath,
+			NomadJobGroupRegexPathFilter: items.NomadJobGroupRegexPathFilter,
+		}.ConvertToV2()
+		controller_name, generation_item, status_item = items.ControllerName, items.Generation, items.Status
+		if !json.Valid([]byte(status_item)) {
+			status_item = "" // the placeholder of the flat format
+		}
+	default:
+		return meta, fmt.Errorf("unsupported spec type %T", spec)
+	}
+
+	generation, err := parseGeneration(generation_item)
+	if err != nil {
+		return
+	}
+	decodeStatus(object, status_item, status)
+	meta = ObjectMeta{
+		OriginalObject: &object,
+		Namespace:      object.Namespace,
+		Path:           object.Path,
+		ApiVersion:     OBJECT_API_VERSION_FLAT,
+		Kind:           kind,
+		ControllerName: controller_name,
+		Generation:     generation,
+	}
+	return
+}
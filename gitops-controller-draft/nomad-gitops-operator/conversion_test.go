@@ -0,0 +1,201 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDecodeStoredGitRepository(t *testing.T) {
+	path := NOMAD_VAR_GITREPOSITORY_PREFIXES[0] + "app"
+	spec := GitRepositorySpec{Url: "https://example.com/app.git", Type: "git", Ref: GitReference{Branch: "main"}}
+	tests := []struct {
+		name        string
+		items       map[string]string
+		api_version string
+		generation  int64
+		commit      string
+		fails       bool
+	}{
+		{
+			name:        "flat",
+			items:       map[string]string{"controller_name": "nomadops", "url": spec.Url, "type": "git", "branch": "main", "status_current_commit": "abc"},
+			api_version: OBJECT_API_VERSION_FLAT,
+			generation:  1,
+			commit:      "abc",
+		},
+		{
+			name: "flat with a status and generation",
+			items: map[string]string{"controller_name": "nomadops", "url": spec.Url, "type": "git", "branch": "main",
+				"status_current_commit": "abc", "generation": "3", "status": `{"current_commit":"def"}`},
+			api_version: OBJECT_API_VERSION_FLAT,
+			generation:  3,
+			commit:      "def",
+		},
+		{
+			name: "v1",
+			items: map[string]string{"api_version": OBJECT_API_VERSION_V1, "kind": OBJECT_KIND_GIT_REPOSITORY, "controller_name": "nomadops",
+				"spec": `{"url":"https://example.com/app.git","type":"git","branch":"main"}`, "generation": "2", "status": `{"current_commit":"abc"}`},
+			api_version: OBJECT_API_VERSION_V1,
+			generation:  2,
+			commit:      "abc",
+		},
+		{
+			name: "v2",
+			items: map[string]string{"api_version": OBJECT_API_VERSION_V2, "kind": OBJECT_KIND_GIT_REPOSITORY, "controller_name": "nomadops",
+				"spec": mustMarshalJSON(spec)},
+			api_version: OBJECT_API_VERSION_V2,
+			generation:  1,
+		},
+		{
+			name: "unreadable status",
+			items: map[string]string{"api_version": OBJECT_API_VERSION_V2, "kind": OBJECT_KIND_GIT_REPOSITORY, "controller_name": "nomadops",
+				"spec": mustMarshalJSON(spec), "status": "{"},
+			api_version: OBJECT_API_VERSION_V2,
+			generation:  1,
+		},
+		{
+			name: "other kind",
+			items: map[string]string{"api_version": OBJECT_API_VERSION_V2, "kind": OBJECT_KIND_NOMAD_JOB_GROUP, "controller_name": "nomadops",
+				"spec": mustMarshalJSON(spec)},
+			fails: true,
+		},
+		{
+			name: "invalid generation",
+			items: map[string]string{"api_version": OBJECT_API_VERSION_V2, "kind": OBJECT_KIND_GIT_REPOSITORY, "controller_name": "nomadops",
+				"spec": mustMarshalJSON(spec), "generation": "two"},
+			fails: true,
+		},
+		{
+			name:  "unknown flat item",
+			items: map[string]string{"controller_name": "nomadops", "url": spec.Url, "type": "git", "branch": "main", "revision": "1"},
+			fails: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decoded_spec, decoded_status := GitRepositorySpec{}, GitRepositoryStatus{}
+			meta, err := decodeStoredObject(StoredObject{Path: path, Items: test.items}, OBJECT_KIND_GIT_REPOSITORY, &decoded_spec, &decoded_status)
+			if test.fails {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(decoded_spec, spec) {
+				t.Fatalf("got spec %+v, want %+v", decoded_spec, spec)
+			}
+			if meta.ApiVersion != test.api_version || meta.Kind != OBJECT_KIND_GIT_REPOSITORY || meta.ControllerName != "nomadops" || meta.Generation != test.generation {
+				t.Fatalf("got meta %+v", meta)
+			}
+			if decoded_status.CurrentCommit != test.commit {
+				t.Fatalf("got commit %q, want %q", decoded_status.CurrentCommit, test.commit)
+			}
+		})
+	}
+}
+
+func TestDecodeStoredNomadJobGroup(t *testing.T) {
+	path := NOMAD_VAR_NOMADJOB_PREFIXES[0] + "app"
+	spec := NomadJobGroupSpec{
+		SourceRef: NOMAD_VAR_GITREPOSITORY_PREFIXES[0] + "app",
+		Jobs:      FileSelector{Path: "jobs", RegexFilter: `\.nomad$`},
+		JobGroups: FileSelector{Path: "groups"},
+	}
+	flat_items := map[string]string{
+		"controller_name":                   "nomadops",
+		"git_repository_name":               spec.SourceRef,
+		"nomad_job_relative_path":           "jobs",
+		"nomad_job_regex_path_filter":       `\.nomad$`,
+		"nomad_job_group_relative_path":     "groups",
+		"nomad_job_group_regex_path_filter": "",
+	}
+	with_items := func(items map[string]string) map[string]string {
+		merged := map[string]string{}
+		for _, source := range []map[string]string{flat_items, items} {
+			for key, value := range source {
+				merged[key] = value
+			}
+		}
+		return merged
+	}
+	tests := []struct {
+		name   string
+		items  map[string]string
+		commit string
+	}{
+		{"flat", flat_items, ""},
+		{"flat with placeholders", with_items(map[string]string{"spec": "placeholder", "status": "placeholder"}), ""},
+		{"flat with a status", with_items(map[string]string{"status": `{"last_applied_commit":"abc"}`}), "abc"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decoded_spec, decoded_status := NomadJobGroupSpec{}, NomadJobGroupStatus{}
+			meta, err := decodeStoredObject(StoredObject{Path: path, Items: test.items}, OBJECT_KIND_NOMAD_JOB_GROUP, &decoded_spec, &decoded_status)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(decoded_spec, spec) {
+				t.Fatalf("got spec %+v, want %+v", decoded_spec, spec)
+			}
+			if meta.ApiVersion != OBJECT_API_VERSION_FLAT || meta.Kind != OBJECT_KIND_NOMAD_JOB_GROUP {
+				t.Fatalf("got meta %+v", meta)
+			}
+			if decoded_status.LastAppliedCommit != test.commit {
+				t.Fatalf("got commit %q, want %q", decoded_status.LastAppliedCommit, test.commit)
+			}
+		})
+	}
+
+	_, err := decodeStoredObject(StoredObject{Path: NOMAD_VAR_GITREPOSITORY_PREFIXES[0] + "app", Items: flat_items}, OBJECT_KIND_NOMAD_JOB_GROUP, &NomadJobGroupSpec{}, &NomadJobGroupStatus{})
+	if err == nil {
+		t.Fatal("expected an error for a flat object whose path is of another kind")
+	}
+}
+
+func TestSpecDocumentRoundTrip(t *testing.T) {
+	tests := []struct {
+		name        string
+		api_version string
+		spec        interface{}
+		decoded     interface{}
+	}{
+		{"GitRepository v1", OBJECT_API_VERSION_V1, GitRepositorySpec{Url: "https://example.com/app.git", Type: "git", Ref: GitReference{Branch: "main"}}, &GitRepositorySpec{}},
+		{"GitRepository v2", OBJECT_API_VERSION_V2, GitRepositorySpec{Url: "https://example.com/app.git", Type: "git", Ref: GitReference{Branch: "main"}}, &GitRepositorySpec{}},
+		{"NomadJobGroup v1", OBJECT_API_VERSION_V1, NomadJobGroupSpec{SourceRef: "repo", Jobs: FileSelector{Path: "jobs"}}, &NomadJobGroupSpec{}},
+		{"NomadJobGroup v2", OBJECT_API_VERSION_V2, NomadJobGroupSpec{SourceRef: "repo", Jobs: FileSelector{Path: "jobs", Include: []string{"**/*.hcl"}}}, &NomadJobGroupSpec{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := decodeSpecDocument(test.api_version, encodeSpecDocument(test.api_version, test.spec), test.decoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if decoded := reflect.ValueOf(test.decoded).Elem().Interface(); !reflect.DeepEqual(decoded, test.spec) {
+				t.Fatalf("got %+v, want %+v", decoded, test.spec)
+			}
+		})
+	}
+
+	if decodeSpecDocument("nomadops/v9", "{}", &GitRepositorySpec{}) == nil {
+		t.Fatal("expected an error for an unsupported api_version")
+	}
+}
+
+func TestGetKindFromPath(t *testing.T) {
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{NOMAD_VAR_GITREPOSITORY_PREFIXES[0] + "app", OBJECT_KIND_GIT_REPOSITORY},
+		{NOMAD_VAR_NOMADJOB_PREFIXES[0] + "app", OBJECT_KIND_NOMAD_JOB_GROUP},
+		{"nomad/jobs/app", ""},
+	}
+	for _, test := range tests {
+		if kind := getKindFromPath(test.path); kind != test.expected {
+			t.Errorf("getKindFromPath(%q) = %q, want %q", test.path, kind, test.expected)
+		}
+	}
+}
@@ -1,40 +1,286 @@
 package main
 
-import "github.com/hashicorp/nomad/api"
+import (
+	"encoding/json"
+	"time"
+)
+
+// Schema constants
+
+const (
+	OBJECT_API_VERSION_V1       = "nomadops/v1"
+	OBJECT_API_VERSION_V2       = "nomadops/v2"
+	OBJECT_API_VERSION_LATEST   = OBJECT_API_VERSION_V2
+	OBJECT_KIND_GIT_REPOSITORY  = "GitRepository"
+	OBJECT_KIND_NOMAD_JOB_GROUP = "NomadJobGroup"
+	MAX_STATUS_EVENTS           = 100
+)
 
 // Structs
 
-type GitRepositoryObjectItems struct {
-	ControllerName      string `hcl:"controller_name"`
-	Url                 string `hcl:"url"`
-	Type                string `hcl:"type"`
-	Branch              string `hcl:"branch"`
-	StatusCurrentCommit string `hcl:"status_current_commit"`
+// ObjectItems is the stored representation of every object, e.g. the `items` of a Nomad Variable.
+// User-owned fields live in the `spec` JSON document and controller-owned fields in the `status` JSON document,
+// so either can grow new fields without breaking variables that were written before those fields existed.
+type ObjectItems struct {
+	ApiVersion     string `hcl:"api_version"`
+	Kind           string `hcl:"kind"`
+	ControllerName string `hcl:"controller_name"`
+	Generation     string `hcl:"generation,optional"`
+	Spec           string `hcl:"spec"`
+	Status         string `hcl:"status,optional"`
+
+	// Set on objects generated from definition files, see ownership.go
+	OwnerPath       string `hcl:"owner_path,optional"`
+	OwnerSourceFile string `hcl:"owner_source_file,optional"`
+
+	// Hash of the user-owned items at the current generation, see RefreshObjectGeneration
+	SpecHash string `hcl:"spec_hash,optional"`
+}
+
+// CONTROLLER_OWNED_ITEMS are the items of an object that the controller writes, all others are owned by the user
+var CONTROLLER_OWNED_ITEMS = []string{"generation", "spec_hash", "status"}
+
+// ObjectFile is the format of object definition files, shared with `nomad var put`
+type ObjectFile struct {
+	Items     ObjectItems `hcl:"items,block"`
+	Namespace string      `hcl:"namespace"`
+	Path      string      `hcl:"path"`
+}
+
+// ObjectMeta holds the fields common to all objects regardless of their kind
+type ObjectMeta struct {
+	OriginalObject  *StoredObject
+	Namespace       string
+	Path            string
+	ApiVersion      string
+	Kind            string
+	ControllerName  string
+	Generation      int64
+	OwnerPath       string
+	OwnerSourceFile string
+}
+
+type GitReference struct {
+	Branch string `json:"branch"`
+}
+
+type GitRepositorySpec struct {
+	Url  string       `json:"url"`
+	Type string       `json:"type"`
+	Ref  GitReference `json:"ref"`
+}
+
+// StatusEvent records a notable change in an object's status, such as a new commit or a failure
+type StatusEvent struct {
+	Time    string `json:"time"`
+	Reason  string `json:"reason"`
+	Message string `json:"message,omitempty"`
+}
+
+type GitRepositoryStatus struct {
+	ObservedGeneration int64         `json:"observed_generation"`
+	CurrentCommit      string        `json:"current_commit"`
+	LastSyncTime       string        `json:"last_sync_time,omitempty"`
+	Message            string        `json:"message,omitempty"`
+	Events             []StatusEvent `json:"events,omitempty"`
+	TruncatedEvents    int           `json:"truncated_events,omitempty"`
 }
 
 type GitRepositoryObject struct {
-	OriginalVariable *api.Variable
-	Items            GitRepositoryObjectItems `hcl:"items"`
-	Namespace        string                   `hcl:"namespace"`
-	Path             string                   `hcl:"path"`
+	ObjectMeta
+	Spec   GitRepositorySpec
+	Status GitRepositoryStatus
+}
+
+// FileSelector selects files from a GitRepository, relative to its root, see file_selection.go
+type FileSelector struct {
+	Path        string   `json:"path"`
+	RegexFilter string   `json:"regex_filter"`      // matched against the file names directly in `path`, ignored if `include` is set
+	Include     []string `json:"include,omitempty"` // glob or `regex:` patterns, matched against repo-relative paths below `path`
+	Exclude     []string `json:"exclude,omitempty"`
+}
+
+type NomadJobGroupSpec struct {
+	SourceRef       string       `json:"source_ref"`       // Nomad Variable path of the GitRepository
+	Jobs            FileSelector `json:"jobs"`             // files that describe Nomad Jobs
+	JobGroups       FileSelector `json:"job_groups"`       // files that describe NomadJobGroups
+	GitRepositories FileSelector `json:"git_repositories"` // files that describe GitRepositories
+	Prune           bool         `json:"prune"`            // deregister this group's jobs when the group is garbage collected
+
+	// HCL2 input variables for the job files, see job_variables.go
+	Variables map[string]json.RawMessage `json:"variables,omitempty"` // inline values, taking precedence over var files
+	VarFiles  []string                   `json:"var_files,omitempty"` // repo-relative variable files, later files take precedence
+
+	Substitution SubstitutionSpec `json:"substitution"`      // `${NAME}` placeholders replaced before parsing, see substitution.go
+	Patches      []string         `json:"patches,omitempty"` // repo-relative patch files applied to the parsed jobs, see job_patches.go
+	Pack         *PackSource      `json:"pack,omitempty"`    // render the jobs from a Nomad Pack instead of selecting files with `jobs`
+
+	BlockOnInvalid bool   `json:"block_on_invalid"`     // register none of the jobs if any job file fails to parse or validate
+	ApplyMode      string `json:"apply_mode,omitempty"` // independent (default) or atomic, see controller_nomadjobgroup.go
+
+	DeploymentTimeout string `json:"deployment_timeout,omitempty"` // how long to wait for deployments, e.g. `10m`, `0s` to not wait
+	RollbackOnFailure bool   `json:"rollback_on_failure"`          // revert jobs with failed deployments to their last stable version
+
+	CanaryAnalysis *CanaryAnalysis `json:"canary_analysis,omitempty"` // promote or fail canary deployments, see canary_analysis.go
+
+	DependsOn []string `json:"depends_on,omitempty"` // paths of NomadJobGroups that must be Ready first, see dependencies.go
+
+	SyncWindows []SyncWindow `json:"sync_windows,omitempty"` // when the group may be synced, see sync_window.go
+
+	ApprovalRequired bool `json:"approval_required"` // only apply new commits once approved, see approvals.go
+	DryRun           bool `json:"dry_run"`           // only plan the jobs, without registering them, see dry_run.go
+
+	IgnoreDifferences []IgnoreRule `json:"ignore_differences,omitempty"` // fields kept as they are registered, see ignore_rules.go
+}
+
+type IgnoreRule struct {
+	Job   string `json:"job,omitempty"` // optional targets, a rule applies to all jobs, groups and tasks that match
+	Group string `json:"group,omitempty"`
+	Task  string `json:"task,omitempty"`
+
+	PreserveCounts  bool     `json:"preserve_counts,omitempty"`
+	MetaKeys        []string `json:"meta_keys,omitempty"`
+	TaskConfigPaths []string `json:"task_config_paths,omitempty"` // e.g. `image` or `labels.version`
+}
+
+type PendingApproval struct {
+	Commit string           `json:"commit"`
+	Since  string           `json:"since"`
+	Plan   []JobPlanSummary `json:"plan"`
+}
+
+type PlanResult struct {
+	Commit    string           `json:"commit"`
+	PlannedAt string           `json:"planned_at"`
+	Jobs      []JobPlanSummary `json:"jobs,omitempty"`
+	Objects   []ObjectChange   `json:"objects,omitempty"` // generated objects that would be created, updated or deleted
+}
+
+type ObjectChange struct {
+	Path       string `json:"path"`
+	Kind       string `json:"kind"`
+	Change     string `json:"change"` // create, update or delete
+	SourceFile string `json:"source_file,omitempty"`
+}
+
+type JobPlanSummary struct {
+	FileName          string   `json:"file_name"`
+	JobName           string   `json:"job_name"`
+	DiffType          string   `json:"diff_type"` // Added, Edited or None
+	Changes           []string `json:"changes,omitempty"`
+	Updates           []string `json:"updates,omitempty"`            // allocations created, updated or destroyed per group
+	PlacementFailures []string `json:"placement_failures,omitempty"` // groups whose allocations can't be placed, and why
+	Warnings          string   `json:"warnings,omitempty"`
+}
+
+type ApprovalRecord struct {
+	Commit     string `json:"commit"`
+	ApprovedBy string `json:"approved_by"`
+	ApprovedAt string `json:"approved_at"`
+	Comment    string `json:"comment,omitempty"`
+	Source     string `json:"source"` // variable or api
 }
 
-type NomadJobGroupObjectItems struct {
-	Spec                         string `hcl:"spec"`
-	Status                       string `hcl:"status"`
-	ControllerName               string `hcl:"controller_name"`
-	GitRepositoryName            string `hcl:"git_repository_name"`
-	NomadJobRelativePath         string `hcl:"nomad_job_relative_path"`
-	NomadJobRegexPathFilter      string `hcl:"nomad_job_regex_path_filter"`
-	NomadJobGroupRelativePath    string `hcl:"nomad_job_group_relative_path"`
-	NomadJobGroupRegexPathFilter string `hcl:"nomad_job_group_regex_path_filter"`
+type SyncWindow struct {
+	Kind     string `json:"kind"`     // allow or deny
+	Schedule string `json:"schedule"` // standard cron expression of when the window opens
+	Duration string `json:"duration"` // how long the window stays open, e.g. `8h`
+}
+
+type CanaryAnalysis struct {
+	SoakTime          string            `json:"soak_time"`                    // how long canaries must be healthy before the checks run, e.g. `5m`
+	PrometheusAddress string            `json:"prometheus_address,omitempty"` // defaults to NOMAD_GITOPS_PROMETHEUS_ADDRESS
+	Checks            []PrometheusCheck `json:"checks,omitempty"`
+}
+
+type PrometheusCheck struct {
+	Name  string   `json:"name"`
+	Query string   `json:"query"` // PromQL instant query
+	Min   *float64 `json:"min,omitempty"`
+	Max   *float64 `json:"max,omitempty"`
+}
+
+// PackSource points at a Nomad Pack in the repository, see pack.go
+type PackSource struct {
+	Path        string   `json:"path"`                   // repo-relative pack directory
+	ValuesFiles []string `json:"values_files,omitempty"` // repo-relative values files, later files take precedence
+}
+
+type SubstitutionSource struct {
+	Kind     string `json:"kind"`     // NomadVariable or ConsulKV
+	Path     string `json:"path"`     // Nomad Variable path, or Consul KV prefix
+	Optional bool   `json:"optional"` // don't fail if the source does not exist or is empty
+}
+
+type SubstitutionSpec struct {
+	SubstituteFrom []SubstitutionSource `json:"substitute_from,omitempty"`
+	Defaults       map[string]string    `json:"defaults,omitempty"` // used for names not set by any source
+	Strict         bool                 `json:"strict,omitempty"`   // fail job files with unresolved placeholders
+}
+
+type NomadJobStatus struct {
+	FileName    string          `json:"file_name"`
+	JobName     string          `json:"job_name,omitempty"`
+	EvalId      string          `json:"eval_id,omitempty"`
+	Error       string          `json:"error,omitempty"`
+	Warning     string          `json:"warning,omitempty"`     // problems that do not fail the file, e.g. unused variables
+	Diagnostics []JobDiagnostic `json:"diagnostics,omitempty"` // parse and validation errors and warnings, see job_validation.go
+
+	Deployment *JobDeploymentStatus `json:"deployment,omitempty"` // outcome of the deployment after registering, see deployments.go
+}
+
+type JobDeploymentStatus struct {
+	ID              string `json:"id,omitempty"`
+	Status          string `json:"status"` // a Nomad deployment status, or `pending`, `none` or `timeout`
+	Description     string `json:"description,omitempty"`
+	DesiredAllocs   int    `json:"desired_allocs,omitempty"`
+	HealthyAllocs   int    `json:"healthy_allocs,omitempty"`
+	UnhealthyAllocs int    `json:"unhealthy_allocs,omitempty"`
+	StartedAt       string `json:"started_at,omitempty"` // when the controller started following it, for the timeout
+}
+
+type JobDiagnostic struct {
+	Severity string `json:"severity"` // error or warning
+	Message  string `json:"message"`
+	Line     int    `json:"line,omitempty"` // position in the job file, if known
+	Column   int    `json:"column,omitempty"`
+}
+
+type NomadJobGroupStatus struct {
+	ObservedGeneration     int64              `json:"observed_generation"`
+	LastAppliedCommit      string             `json:"last_applied_commit"`
+	ConvergedCommit        string             `json:"converged_commit,omitempty"`     // last commit all job files were registered from
+	Ready                  bool               `json:"ready"`                          // all jobs are registered and their deployments successful
+	FailedCommit           string             `json:"failed_commit,omitempty"`        // commit whose deployments failed and were rolled back, not applied again
+	BlockedReason          string             `json:"blocked_reason,omitempty"`       // why the group waits for its dependencies
+	PendingCommit          string             `json:"pending_commit,omitempty"`       // commit waiting for the next sync window
+	NextSyncWindow         string             `json:"next_sync_window,omitempty"`     // when syncing is next allowed
+	SyncWindowOverride     string             `json:"sync_window_override,omitempty"` // sync regardless of the windows until this time
+	AwaitingApproval       *PendingApproval   `json:"awaiting_approval,omitempty"`    // planned changes of a commit that is not approved yet
+	ApprovedCommit         string             `json:"approved_commit,omitempty"`
+	DryRunPlan             *PlanResult        `json:"dry_run_plan,omitempty"` // what applying the current commit would do, while dry running
+	Approvals              []ApprovalRecord   `json:"approvals,omitempty"`    // audit trail of the approvals applied, oldest first
+	HookRuns               map[string]HookRun `json:"hook_runs,omitempty"`    // last run of each hook job by job ID, see sync_waves.go
+	LastReconciliationTime string             `json:"last_reconciliation_time,omitempty"`
+	SelectedFiles          []string           `json:"selected_files,omitempty"` // job files selected at the last applied commit
+	Jobs                   []NomadJobStatus   `json:"jobs,omitempty"`
+	Message                string             `json:"message,omitempty"`
+	Events                 []StatusEvent      `json:"events,omitempty"`
+	TruncatedEvents        int                `json:"truncated_events,omitempty"`
+}
+
+type HookRun struct {
+	Commit      string `json:"commit"`
+	JobHash     string `json:"job_hash"` // the hook runs again if its job changes without a new commit, e.g. through variables
+	Status      string `json:"status"`   // running, or successful once completed
+	Description string `json:"description,omitempty"`
+	FinishedAt  string `json:"finished_at,omitempty"`
 }
 
 type NomadJobGroupObject struct {
-	OriginalVariable *api.Variable
-	Items            NomadJobGroupObjectItems `hcl:"items,block"`
-	Namespace        string                   `hcl:"namespace"`
-	Path             string                   `hcl:"path"`
+	ObjectMeta
+	Spec   NomadJobGroupSpec
+	Status NomadJobGroupStatus
 }
 
 // Interfaces
@@ -47,26 +293,78 @@ type ControllerObject interface {
 
 // Functions
 
-func (obj NomadJobGroupObject) GetPath() string           { return obj.Path }
-func (obj GitRepositoryObject) GetPath() string           { return obj.Path }
-func (obj NomadJobGroupObject) GetNamespace() string      { return obj.Namespace }
-func (obj GitRepositoryObject) GetNamespace() string      { return obj.Namespace }
-func (obj NomadJobGroupObject) GetControllerName() string { return obj.Items.ControllerName }
-func (obj GitRepositoryObject) GetControllerName() string { return obj.Items.ControllerName }
-
-func (nomad_job_group_object NomadJobGroupObject) ConvertToNomadVariable() *api.Variable {
-	return &api.Variable{
-		Path:      nomad_job_group_object.Path,
-		Namespace: nomad_job_group_object.Namespace,
-		Items: api.VariableItems{
-			"spec":                              nomad_job_group_object.Items.Spec,
-			"status":                            nomad_job_group_object.Items.Status,
-			"controller_name":                   nomad_job_group_object.Items.ControllerName,
-			"git_repository_name":               nomad_job_group_object.Items.GitRepositoryName,
-			"nomad_job_relative_path":           nomad_job_group_object.Items.NomadJobRelativePath,
-			"nomad_job_regex_path_filter":       nomad_job_group_object.Items.NomadJobRegexPathFilter,
-			"nomad_job_group_relative_path":     nomad_job_group_object.Items.NomadJobGroupRelativePath,
-			"nomad_job_group_regex_path_filter": nomad_job_group_object.Items.NomadJobGroupRegexPathFilter,
+func (spec SubstitutionSpec) IsEmpty() bool {
+	return len(spec.SubstituteFrom) == 0 && len(spec.Defaults) == 0 && !spec.Strict
+}
+
+func (selector FileSelector) IsEmpty() bool {
+	return selector.Path == "" && selector.RegexFilter == "" && len(selector.Include) == 0
+}
+
+func (obj ObjectMeta) GetPath() string           { return obj.Path }
+func (obj ObjectMeta) GetNamespace() string      { return obj.Namespace }
+func (obj ObjectMeta) GetControllerName() string { return obj.ControllerName }
+
+func (object_file ObjectFile) ConvertToStoredObject() *StoredObject {
+	return setOwnerItems(&StoredObject{
+		Path:      object_file.Path,
+		Namespace: object_file.Namespace,
+		Items: map[string]string{
+			"api_version":     object_file.Items.ApiVersion,
+			"kind":            object_file.Items.Kind,
+			"controller_name": object_file.Items.ControllerName,
+			"generation":      object_file.Items.Generation,
+			"spec":            object_file.Items.Spec,
+			"status":          object_file.Items.Status,
 		},
+	}, object_file.Items.OwnerPath, object_file.Items.OwnerSourceFile)
+}
+
+// appendStatusEvent adds an event unless it repeats the latest one, keeping at most MAX_STATUS_EVENTS
+func appendStatusEvent(events []StatusEvent, reason string, message string) []StatusEvent {
+	if len(events) > 0 && events[len(events)-1].Reason == reason && events[len(events)-1].Message == message {
+		return events
+	}
+	events = append(events, StatusEvent{Time: time.Now().Format(time.RFC3339), Reason: reason, Message: message})
+	return events[max(len(events)-MAX_STATUS_EVENTS, 0):]
+}
+
+// truncateOldestEvents drops the older half of the events, returning how many were dropped
+func truncateOldestEvents(events *[]StatusEvent) int {
+	dropped := (len(*events) + 1) / 2
+	*events = (*events)[dropped:]
+	return dropped
+}
+
+func (status *GitRepositoryStatus) TruncateOldest() bool {
+	if len(status.Events) == 0 {
+		return false
+	}
+	status.TruncatedEvents += truncateOldestEvents(&status.Events)
+	return true
+}
+
+func (status *NomadJobGroupStatus) TruncateOldest() bool {
+	if len(status.Events) == 0 {
+		return false
+	}
+	status.TruncatedEvents += truncateOldestEvents(&status.Events)
+	return true
+}
+
+// setOwnerItems adds the owner items to an object, only if it has an owner
+func setOwnerItems(object *StoredObject, owner_path string, owner_source_file string) *StoredObject {
+	if owner_path != "" {
+		object.Items["owner_path"] = owner_path
+		object.Items["owner_source_file"] = owner_source_file
+	}
+	return object
+}
+
+func mustMarshalJSON(value interface{}) string {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		panic(err) // only plain structs are marshalled here, so this can only fail during dev
 	}
+	return string(encoded)
 }
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A NomadJobGroup can list the paths of other NomadJobGroups in its `depends_on`, e.g. to deploy databases and ingress
+// before the applications using them. A group is only reconciled once all its dependencies are Ready at the current
+// commit of their repositories, i.e. their deployments at that commit are successful. Groups are reconciled with their
+// dependencies first, so a group whose dependencies become ready is reconciled in the same run. A dependency that won't
+// become ready at its current commit, as its deployments failed or it is a dry run, is reported as such in the blocked
+// reason, rather than as something the group is waiting for.
+
+// OrderNomadJobGroupsByDependencies returns the groups with their dependencies before them, otherwise in their original
+// order, and for every group in a dependency cycle a description of the cycle
+func OrderNomadJobGroupsByDependencies(groups []NomadJobGroupObject) (ordered []*NomadJobGroupObject, cycles map[string]string) {
+	groups_by_path := map[string]*NomadJobGroupObject{}
+	for index := range groups {
+		groups_by_path[groups[index].Path] = &groups[index]
+	}
+
+	cycles = map[string]string{}
+	visited := map[string]bool{}
+	stack := []string{} // paths being visited, to describe cycles
+	var visit func(group *NomadJobGroupObject)
+	visit = func(group *NomadJobGroupObject) {
+		for stack_index, path := range stack {
+			if path == group.Path {
+				cycle := append(append([]string{}, stack[stack_index:]...), group.Path)
+				for _, cycle_path := range cycle {
+					cycles[cycle_path] = strings.Join(cycle, " -> ")
+				}
+				return
+			}
+		}
+		if visited[group.Path] {
+			return
+		}
+		stack = append(stack, group.Path)
+		for _, dependency_path := range group.Spec.DependsOn {
+			if dependency, exists := groups_by_path[dependency_path]; exists {
+				visit(dependency)
+			}
+		}
+		stack = stack[:len(stack)-1]
+		visited[group.Path] = true
+		ordered = append(ordered, group)
+	}
+	for index := range groups {
+		visit(&groups[index])
+	}
+	return
+}
+
+// GetDependencyBlockedReason returns why a group has to wait for its dependencies, or an empty string if it doesn't
+func GetDependencyBlockedReason(job *NomadJobGroupObject, ordered []*NomadJobGroupObject, cycles map[string]string, repositories *[]GitRepositoryObject) string {
+	if cycle, in_cycle := cycles[job.Path]; in_cycle {
+		return "dependency cycle: " + cycle
+	}
+	for _, dependency_path := range job.Spec.DependsOn {
+		var dependency *NomadJobGroupObject
+		for _, group := range ordered {
+			if group.Path == dependency_path {
+				dependency = group
+			}
+		}
+		if dependency == nil {
+			return fmt.Sprintf("depends on %s, which does not exist", dependency_path)
+		}
+		dependency_repo, err := GetGitRepositoryForNomadJobGroup(*dependency, repositories)
+		if err != nil {
+			return fmt.Sprintf("depends on %s, whose repository is missing", dependency_path)
+		}
+		if dependency.Status.FailedCommit != "" && dependency.Status.FailedCommit == dependency_repo.Status.CurrentCommit {
+			return fmt.Sprintf("depends on %s, which failed at commit %s and is not ready until a new commit", dependency_path, dependency.Status.FailedCommit)
+		}
+		if dependency.Spec.DryRun {
+			return fmt.Sprintf("depends on %s, which is a dry run and never ready", dependency_path)
+		}
+		if !dependency.Status.Ready {
+			return fmt.Sprintf("waiting for %s to be ready", dependency_path)
+		}
+		if dependency.Status.ConvergedCommit != dependency_repo.Status.CurrentCommit {
+			return fmt.Sprintf("waiting for %s to be ready at commit %s", dependency_path, dependency_repo.Status.CurrentCommit)
+		}
+	}
+	return ""
+}
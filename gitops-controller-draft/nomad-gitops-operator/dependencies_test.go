@@ -0,0 +1,168 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testNomadJobGroups builds groups from `path: dependency, dependency` lines, all using the repository `repo`
+func testNomadJobGroups(definitions ...string) (groups []NomadJobGroupObject) {
+	for _, definition := range definitions {
+		path, depends_on, _ := strings.Cut(definition, ":")
+		group := NomadJobGroupObject{ObjectMeta: ObjectMeta{Path: path}, Spec: NomadJobGroupSpec{SourceRef: "repo"}}
+		for _, dependency := range strings.Split(depends_on, ",") {
+			if dependency = strings.TrimSpace(dependency); dependency != "" {
+				group.Spec.DependsOn = append(group.Spec.DependsOn, dependency)
+			}
+		}
+		groups = append(groups, group)
+	}
+	return
+}
+
+func TestOrderNomadJobGroupsByDependencies(t *testing.T) {
+	tests := []struct {
+		name     string
+		groups   []string
+		expected []string
+		cycles   map[string]string
+	}{
+		{
+			name:     "no dependencies keeps the order",
+			groups:   []string{"c", "a", "b"},
+			expected: []string{"c", "a", "b"},
+			cycles:   map[string]string{},
+		},
+		{
+			name:     "dependencies first",
+			groups:   []string{"app: db, ingress", "ingress", "db: volumes", "volumes"},
+			expected: []string{"volumes", "db", "ingress", "app"},
+			cycles:   map[string]string{},
+		},
+		{
+			name:     "shared dependency once",
+			groups:   []string{"web: db", "worker: db", "db"},
+			expected: []string{"db", "web", "worker"},
+			cycles:   map[string]string{},
+		},
+		{
+			name:     "missing dependency ignored",
+			groups:   []string{"app: missing"},
+			expected: []string{"app"},
+			cycles:   map[string]string{},
+		},
+		{
+			name:     "cycle",
+			groups:   []string{"a: b", "b: c", "c: a", "d"},
+			expected: []string{"c", "b", "a", "d"},
+			cycles:   map[string]string{"a": "a -> b -> c -> a", "b": "a -> b -> c -> a", "c": "a -> b -> c -> a"},
+		},
+		{
+			name:     "depends on itself",
+			groups:   []string{"a: a"},
+			expected: []string{"a"},
+			cycles:   map[string]string{"a": "a -> a"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ordered, cycles := OrderNomadJobGroupsByDependencies(testNomadJobGroups(test.groups...))
+			paths := []string{}
+			for _, group := range ordered {
+				paths = append(paths, group.Path)
+			}
+			if !reflect.DeepEqual(paths, test.expected) {
+				t.Fatalf("got order %v, want %v", paths, test.expected)
+			}
+			if !reflect.DeepEqual(cycles, test.cycles) {
+				t.Fatalf("got cycles %v, want %v", cycles, test.cycles)
+			}
+		})
+	}
+}
+
+func TestGetDependencyBlockedReason(t *testing.T) {
+	repositories := []GitRepositoryObject{{ObjectMeta: ObjectMeta{Path: "repo"}, Status: GitRepositoryStatus{CurrentCommit: "new"}}}
+	tests := []struct {
+		name       string
+		groups     []string
+		dependency NomadJobGroupStatus
+		source_ref string
+		dry_run    bool
+		expected   string
+	}{
+		{
+			name:       "ready at the current commit",
+			groups:     []string{"app: db", "db"},
+			dependency: NomadJobGroupStatus{Ready: true, ConvergedCommit: "new"},
+			expected:   "",
+		},
+		{
+			name:       "not ready",
+			groups:     []string{"app: db", "db"},
+			dependency: NomadJobGroupStatus{Ready: false, ConvergedCommit: "new"},
+			expected:   "waiting for db to be ready",
+		},
+		{
+			name:       "ready at an older commit",
+			groups:     []string{"app: db", "db"},
+			dependency: NomadJobGroupStatus{Ready: true, ConvergedCommit: "old"},
+			expected:   "waiting for db to be ready at commit new",
+		},
+		{
+			name:       "failed at the current commit",
+			groups:     []string{"app: db", "db"},
+			dependency: NomadJobGroupStatus{Ready: false, ConvergedCommit: "old", FailedCommit: "new"},
+			expected:   "depends on db, which failed at commit new and is not ready until a new commit",
+		},
+		{
+			name:       "failed at an older commit",
+			groups:     []string{"app: db", "db"},
+			dependency: NomadJobGroupStatus{Ready: false, ConvergedCommit: "old", FailedCommit: "old"},
+			expected:   "waiting for db to be ready",
+		},
+		{
+			name:       "dry run",
+			groups:     []string{"app: db", "db"},
+			dependency: NomadJobGroupStatus{Ready: false},
+			dry_run:    true,
+			expected:   "depends on db, which is a dry run and never ready",
+		},
+		{
+			name:     "missing",
+			groups:   []string{"app: db"},
+			expected: "depends on db, which does not exist",
+		},
+		{
+			name:       "repository missing",
+			groups:     []string{"app: db", "db"},
+			source_ref: "other",
+			expected:   "depends on db, whose repository is missing",
+		},
+		{
+			name:     "cycle",
+			groups:   []string{"app: db", "db: app"},
+			expected: "dependency cycle: app -> db -> app",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			groups := testNomadJobGroups(test.groups...)
+			for index := range groups {
+				if groups[index].Path == "db" {
+					groups[index].Status = test.dependency
+					groups[index].Spec.DryRun = test.dry_run
+					if test.source_ref != "" {
+						groups[index].Spec.SourceRef = test.source_ref
+					}
+				}
+			}
+			ordered, cycles := OrderNomadJobGroupsByDependencies(groups)
+			reason := GetDependencyBlockedReason(&groups[0], ordered, cycles, &repositories)
+			if reason != test.expected {
+				t.Fatalf("got %q, want %q", reason, test.expected)
+			}
+		})
+	}
+}
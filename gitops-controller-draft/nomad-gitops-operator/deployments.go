@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/nomad/api"
+	"go.uber.org/zap"
+)
+
+// After registering the jobs of a NomadJobGroup, the controller follows each registration's evaluation to its
+// deployment, checking on it once per run rather than waiting for it, so that reconciling one group never holds up the
+// others. The evaluation and deployment being followed are kept in the status of the job file, and followed on later
+// runs for as long as the job is unchanged. The group is only Ready once all deployments are successful, i.e. their
+// allocations are healthy. Jobs without deployments, such as batch jobs or jobs without an `update` block, are
+// considered done once their evaluation completes with every allocation placed. Deployments running for longer than the
+// deployment timeout of the group are reported as stuck, and still followed in case they finish after all.
+const (
+	DEPLOYMENT_STATUS_PENDING = "pending" // the evaluation of the registration has not completed yet
+	DEPLOYMENT_STATUS_NONE    = "none"    // the job has no deployment
+	DEPLOYMENT_STATUS_STUCK   = "timeout" // the deployment did not finish within the deployment timeout
+)
+
+// GetDeploymentTimeout returns how long deployments of a NomadJobGroup may run before they are reported as stuck, zero
+// for no limit
+func GetDeploymentTimeout(spec NomadJobGroupSpec) (time.Duration, error) {
+	timeout := DEPLOYMENT_TIMEOUT
+	if spec.DeploymentTimeout != "" {
+		timeout = spec.DeploymentTimeout
+	}
+	duration, err := time.ParseDuration(timeout)
+	if err != nil {
+		return 0, fmt.Errorf("invalid deployment_timeout %q: %w", timeout, err)
+	}
+	return duration, nil
+}
+
+// CheckDeployment checks once on the deployment of a job, continuing from the deployment tracked on earlier runs, if
+// any. `eval_id` is the evaluation of the job's registration; if it is empty, e.g. as the job was last registered
+// before the controller tracked deployments, the latest deployment of the job is followed instead. Running deployments
+// with canaries are analysed, and promoted or failed accordingly, or failed once they run past the timeout.
+func CheckDeployment(client *api.Client, job *api.Job, eval_id string, tracked *JobDeploymentStatus, timeout time.Duration, analysis *CanaryAnalysis) (*JobDeploymentStatus, error) {
+	query_options := &api.QueryOptions{Namespace: *job.Namespace}
+	write_options := &api.WriteOptions{Namespace: *job.Namespace}
+	status := newTrackedDeploymentStatus(tracked)
+	if tracked != nil && tracked.Finished() {
+		return tracked, nil // nothing changes anymore while the job is unchanged
+	}
+
+	if status.ID == "" && eval_id != "" {
+		evaluation, failure, err := checkEvaluation(client, eval_id, query_options)
+		if err != nil || failure != nil {
+			return failure, err
+		}
+		if evaluation == nil {
+			status.Status = DEPLOYMENT_STATUS_PENDING
+			status.Description = "evaluation pending"
+			return status.checkTimeout(timeout), nil
+		}
+		if evaluation.DeploymentID == "" {
+			return &JobDeploymentStatus{Status: DEPLOYMENT_STATUS_NONE}, nil
+		}
+		status.ID = evaluation.DeploymentID
+	} else if status.ID == "" {
+		deployment, _, err := client.Jobs().LatestDeployment(*job.ID, query_options)
+		if err != nil {
+			return nil, err
+		}
+		if deployment == nil {
+			return &JobDeploymentStatus{Status: DEPLOYMENT_STATUS_NONE}, nil
+		}
+		status.ID = deployment.ID
+	}
+
+	deployment, _, err := client.Deployments().Info(status.ID, query_options)
+	if err != nil {
+		return nil, err
+	}
+	status.Status, status.Description = deployment.Status, deployment.StatusDescription
+	for _, state := range deployment.TaskGroups {
+		status.DesiredAllocs += state.DesiredTotal
+		status.HealthyAllocs += state.HealthyAllocs
+		status.UnhealthyAllocs += state.UnhealthyAllocs
+	}
+	if deployment.Status != api.DeploymentStatusRunning {
+		return status, nil
+	}
+
+	if analysis != nil {
+		action, reason, err := analyzeCanaries(client, deployment, analysis, query_options)
+		if err != nil {
+			return nil, err
+		}
+		switch action {
+		case CANARY_ACTION_PROMOTE:
+			logger.Info("promoting deployment after canary analysis",
+				zap.String("deploymentId", deployment.ID),
+				zap.String("reason", reason),
+			)
+			_, _, err = client.Deployments().PromoteAll(deployment.ID, write_options)
+			status.Description = "promoted: " + reason
+		case CANARY_ACTION_FAIL:
+			logger.Warn("failing deployment after canary analysis",
+				zap.String("deploymentId", deployment.ID),
+				zap.String("reason", reason),
+			)
+			_, _, err = client.Deployments().Fail(deployment.ID, write_options)
+			status.Status = api.DeploymentStatusFailed
+			status.Description = reason
+		}
+		if err != nil {
+			return nil, err
+		}
+		if action == CANARY_ACTION_FAIL {
+			return status, nil
+		}
+	}
+	status.checkTimeout(timeout)
+	if analysis != nil && status.Status == DEPLOYMENT_STATUS_STUCK {
+		// Otherwise the deployment would await promotion forever, as the analysis couldn't decide
+		logger.Warn("failing deployment as its canary analysis did not complete within the deployment timeout",
+			zap.String("deploymentId", deployment.ID),
+		)
+		if _, _, err := client.Deployments().Fail(deployment.ID, write_options); err != nil {
+			return nil, err
+		}
+		status.Status = api.DeploymentStatusFailed
+	}
+	return status, nil
+}
+
+// checkEvaluation returns the evaluation once it completed, nil while it is pending, or a failed status if it did not
+// complete with all allocations placed
+func checkEvaluation(client *api.Client, eval_id string, query_options *api.QueryOptions) (*api.Evaluation, *JobDeploymentStatus, error) {
+	evaluation, _, err := client.Evaluations().Info(eval_id, query_options)
+	if err != nil {
+		return nil, nil, err
+	}
+	if evaluation.Status == "pending" {
+		return nil, nil, nil
+	}
+	if evaluation.Status != "complete" {
+		return nil, &JobDeploymentStatus{Status: api.DeploymentStatusFailed, Description: "evaluation " + evaluation.Status + ": " + evaluation.StatusDescription}, nil
+	}
+	for group_name, metric := range evaluation.FailedTGAllocs {
+		return nil, &JobDeploymentStatus{
+			Status:      api.DeploymentStatusFailed,
+			Description: fmt.Sprintf("failed to place allocations of group %s, %d nodes exhausted", group_name, metric.NodesExhausted),
+		}, nil
+	}
+	return evaluation, nil, nil
+}
+
+// newTrackedDeploymentStatus starts this run's status from the one tracked on earlier runs, keeping when it started
+func newTrackedDeploymentStatus(tracked *JobDeploymentStatus) *JobDeploymentStatus {
+	status := &JobDeploymentStatus{StartedAt: time.Now().Format(time.RFC3339)}
+	if tracked != nil {
+		status.ID = tracked.ID
+		if tracked.StartedAt != "" {
+			status.StartedAt = tracked.StartedAt
+		}
+	}
+	return status
+}
+
+// checkTimeout reports a deployment that is still in progress as stuck, once it has run for longer than the timeout
+func (status *JobDeploymentStatus) checkTimeout(timeout time.Duration) *JobDeploymentStatus {
+	started_at, err := time.Parse(time.RFC3339, status.StartedAt)
+	if timeout > 0 && err == nil && time.Since(started_at) > timeout {
+		status.Description = fmt.Sprintf("still %s after the deployment timeout of %s: %s", status.Status, timeout, status.Description)
+		status.Status = DEPLOYMENT_STATUS_STUCK
+	}
+	return status
+}
+
+// Finished returns whether the deployment reached a final status, which doesn't change anymore
+func (status *JobDeploymentStatus) Finished() bool {
+	switch status.Status {
+	case api.DeploymentStatusSuccessful, api.DeploymentStatusFailed, api.DeploymentStatusCancelled, DEPLOYMENT_STATUS_NONE:
+		return true
+	}
+	return false
+}
+
+// InProgress returns whether the deployment is still going, as opposed to finished or stuck
+func (status *JobDeploymentStatus) InProgress() bool {
+	return !status.Finished() && status.Status != DEPLOYMENT_STATUS_STUCK
+}
+
+// Healthy returns whether the deployment finished with all its allocations healthy
+func (status *JobDeploymentStatus) Healthy() bool {
+	return status.Status == api.DeploymentStatusSuccessful || status.Status == DEPLOYMENT_STATUS_NONE
+}
+
+// ShouldRollBack returns whether a job's deployment failed after the controller registered it, whether the failure was
+// found on the run that registered the job or on a later one. Hooks are not rolled back, and neither are jobs whose
+// deployment was not followed from a registration, e.g. one only looked up as the latest deployment of the job.
+func ShouldRollBack(job_status *NomadJobStatus, job *api.Job) bool {
+	deployment := job_status.Deployment
+	return job_status.EvalId != "" && deployment != nil && deployment.Status == api.DeploymentStatusFailed && !isHookJob(job)
+}
+
+// RevertToLastStableVersion reverts a job to the latest of its earlier versions that Nomad marked as stable, i.e. whose
+// deployment succeeded, returning the version reverted to
+func RevertToLastStableVersion(client *api.Client, job *api.Job) (uint64, error) {
+	versions, _, _, err := client.Jobs().Versions(*job.ID, false, &api.QueryOptions{Namespace: *job.Namespace})
+	if err != nil {
+		return 0, err
+	}
+	if len(versions) == 0 {
+		return 0, fmt.Errorf("job %s has no versions", *job.ID)
+	}
+	current_version := versions[0].Version // newest first
+	for _, version := range versions[1:] {
+		if version.Stable == nil || !*version.Stable {
+			continue
+		}
+		_, _, err = client.Jobs().Revert(*job.ID, *version.Version, current_version, &api.WriteOptions{Namespace: *job.Namespace}, "", "")
+		if err != nil {
+			return 0, err
+		}
+		return *version.Version, nil
+	}
+	return 0, fmt.Errorf("job %s has no earlier stable version to revert to", *job.ID)
+}
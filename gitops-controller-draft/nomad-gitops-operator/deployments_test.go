@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad/api"
+)
+
+// testNomadDeployments fakes the evaluation and deployment endpoints of Nomad used by CheckDeployment
+type testNomadDeployments struct {
+	evaluations map[string]*api.Evaluation
+	deployments map[string]*api.Deployment
+	latest      map[string]string // job ID to the ID of its latest deployment
+	failed      []string          // IDs of the deployments failed through the API
+}
+
+func (nomad *testNomadDeployments) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	var response interface{}
+	switch path := request.URL.Path; {
+	case strings.HasPrefix(path, "/v1/deployment/fail/"):
+		nomad.failed = append(nomad.failed, strings.TrimPrefix(path, "/v1/deployment/fail/"))
+		response = &api.DeploymentUpdateResponse{}
+	case strings.HasPrefix(path, "/v1/evaluation/"):
+		response = nomad.evaluations[strings.TrimPrefix(path, "/v1/evaluation/")]
+	case strings.HasPrefix(path, "/v1/deployment/"):
+		response = nomad.deployments[strings.TrimPrefix(path, "/v1/deployment/")]
+	case strings.HasPrefix(path, "/v1/job/") && strings.HasSuffix(path, "/deployment"):
+		deployment_id := nomad.latest[strings.TrimSuffix(strings.TrimPrefix(path, "/v1/job/"), "/deployment")]
+		if deployment_id == "" {
+			response = (*api.Deployment)(nil) // jobs without deployments return null
+			break
+		}
+		response = nomad.deployments[deployment_id]
+	}
+	if response == nil {
+		http.NotFound(writer, request)
+		return
+	}
+	writer.Header().Set("X-Nomad-Index", "1")
+	writer.Header().Set("X-Nomad-LastContact", "0")
+	writer.Header().Set("X-Nomad-KnownLeader", "true")
+	json.NewEncoder(writer).Encode(response)
+}
+
+func TestCheckDeployment(t *testing.T) {
+	nomad := &testNomadDeployments{
+		evaluations: map[string]*api.Evaluation{
+			"eval-pending":       {ID: "eval-pending", Status: "pending"},
+			"eval-no-deployment": {ID: "eval-no-deployment", Status: "complete"},
+			"eval-running":       {ID: "eval-running", Status: "complete", DeploymentID: "deployment-running"},
+			"eval-unplaced":      {ID: "eval-unplaced", Status: "complete", FailedTGAllocs: map[string]*api.AllocationMetric{"web": {NodesExhausted: 2}}},
+		},
+		deployments: map[string]*api.Deployment{
+			"deployment-running":    {ID: "deployment-running", Status: api.DeploymentStatusRunning, TaskGroups: map[string]*api.DeploymentState{"web": {DesiredTotal: 3, HealthyAllocs: 1}}},
+			"deployment-successful": {ID: "deployment-successful", Status: api.DeploymentStatusSuccessful},
+		},
+		latest: map[string]string{"web": "deployment-successful"},
+	}
+	server := httptest.NewServer(nomad)
+	defer server.Close()
+	client, err := api.NewClient(&api.Config{Address: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job_id, namespace := "web", "default"
+	job := &api.Job{ID: &job_id, Namespace: &namespace}
+	long_ago := time.Now().Add(-time.Hour).Format(time.RFC3339)
+	tests := []struct {
+		name        string
+		eval_id     string
+		tracked     *JobDeploymentStatus
+		timeout     time.Duration
+		status      string
+		id          string
+		in_progress bool
+	}{
+		{"evaluation pending", "eval-pending", nil, 0, DEPLOYMENT_STATUS_PENDING, "", true},
+		{"evaluation without a deployment", "eval-no-deployment", nil, 0, DEPLOYMENT_STATUS_NONE, "", false},
+		{"allocations not placed", "eval-unplaced", nil, 0, api.DeploymentStatusFailed, "", false},
+		{"deployment of the evaluation running", "eval-running", nil, 0, api.DeploymentStatusRunning, "deployment-running", true},
+		{"tracked deployment checked again", "eval-running", &JobDeploymentStatus{ID: "deployment-successful", Status: api.DeploymentStatusRunning}, 0, api.DeploymentStatusSuccessful, "deployment-successful", false},
+		{"tracked deployment running past the timeout", "eval-running", &JobDeploymentStatus{ID: "deployment-running", Status: api.DeploymentStatusRunning, StartedAt: long_ago}, 10 * time.Minute, DEPLOYMENT_STATUS_STUCK, "deployment-running", false},
+		{"tracked deployment running without a timeout", "eval-running", &JobDeploymentStatus{ID: "deployment-running", Status: api.DeploymentStatusRunning, StartedAt: long_ago}, 0, api.DeploymentStatusRunning, "deployment-running", true},
+		{"finished deployment not checked again", "eval-running", &JobDeploymentStatus{ID: "deployment-gone", Status: api.DeploymentStatusFailed}, 0, api.DeploymentStatusFailed, "deployment-gone", false},
+		{"latest deployment without an evaluation", "", nil, 0, api.DeploymentStatusSuccessful, "deployment-successful", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status, err := CheckDeployment(client, job, test.eval_id, test.tracked, test.timeout, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status.Status != test.status || status.ID != test.id || status.InProgress() != test.in_progress {
+				t.Fatalf("got %+v, want status %s of deployment %q, in progress %t", status, test.status, test.id, test.in_progress)
+			}
+			if test.tracked != nil && test.tracked.StartedAt != "" && status.StartedAt != test.tracked.StartedAt {
+				t.Fatalf("got started_at %s, want the tracked %s", status.StartedAt, test.tracked.StartedAt)
+			}
+		})
+	}
+}
+
+func TestCheckDeploymentFailsStuckCanaryAnalysis(t *testing.T) {
+	nomad := &testNomadDeployments{deployments: map[string]*api.Deployment{
+		"deployment-canaries": {ID: "deployment-canaries", Status: api.DeploymentStatusRunning, TaskGroups: map[string]*api.DeploymentState{"web": {DesiredCanaries: 1}}},
+	}}
+	server := httptest.NewServer(nomad)
+	defer server.Close()
+	client, err := api.NewClient(&api.Config{Address: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job_id, namespace := "web", "default"
+	job := &api.Job{ID: &job_id, Namespace: &namespace}
+	analysis := &CanaryAnalysis{SoakTime: "5m"}
+	tracked := &JobDeploymentStatus{ID: "deployment-canaries", Status: api.DeploymentStatusRunning, StartedAt: time.Now().Add(-time.Minute).Format(time.RFC3339)}
+	status, err := CheckDeployment(client, job, "eval", tracked, 10*time.Minute, analysis)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Status != api.DeploymentStatusRunning || len(nomad.failed) != 0 {
+		t.Fatalf("got %+v, failed %v, want the deployment still running within the timeout", status, nomad.failed)
+	}
+
+	tracked.StartedAt = time.Now().Add(-time.Hour).Format(time.RFC3339)
+	status, err = CheckDeployment(client, job, "eval", tracked, 10*time.Minute, analysis)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Status != api.DeploymentStatusFailed || len(nomad.failed) != 1 || nomad.failed[0] != "deployment-canaries" {
+		t.Fatalf("got %+v, failed %v, want the deployment failed past the timeout", status, nomad.failed)
+	}
+}
+
+func TestShouldRollBack(t *testing.T) {
+	service_job := &api.Job{}
+	hook_job := &api.Job{Meta: map[string]string{HOOK_META_KEY: HOOK_PRE_SYNC}}
+	tests := []struct {
+		name       string
+		job_status NomadJobStatus
+		job        *api.Job
+		expected   bool
+	}{
+		{"failed deployment of a registration", NomadJobStatus{EvalId: "eval", Deployment: &JobDeploymentStatus{Status: api.DeploymentStatusFailed}}, service_job, true},
+		{"running deployment", NomadJobStatus{EvalId: "eval", Deployment: &JobDeploymentStatus{Status: api.DeploymentStatusRunning}}, service_job, false},
+		{"stuck deployment", NomadJobStatus{EvalId: "eval", Deployment: &JobDeploymentStatus{Status: DEPLOYMENT_STATUS_STUCK}}, service_job, false},
+		{"not followed from a registration", NomadJobStatus{Deployment: &JobDeploymentStatus{Status: api.DeploymentStatusFailed}}, service_job, false},
+		{"failed to follow the deployment", NomadJobStatus{EvalId: "eval", Error: "failed to follow deployment"}, service_job, false},
+		{"failed hook", NomadJobStatus{EvalId: "eval", Deployment: &JobDeploymentStatus{Status: api.DeploymentStatusFailed}}, hook_job, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if actual := ShouldRollBack(&test.job_status, test.job); actual != test.expected {
+				t.Fatalf("got %t, want %t", actual, test.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/nomad/api"
+)
+
+// A NomadJobGroup with `dry_run`, or every group while NOMAD_GITOPS_DRY_RUN is `true`, is reconciled up to planning its
+// jobs, without registering, rolling back or pruning anything. The objects it generates from definition files are not
+// created, updated or garbage collected either. The plan of every job and the changes to generated objects are stored
+// in the status as `dry_run_plan`, so a new repository or controller can be onboarded onto an existing cluster after
+// seeing what it would do. Dependencies and sync windows do not hold back dry runs, as nothing is applied.
+const (
+	OBJECT_CHANGE_CREATE = "create"
+	OBJECT_CHANGE_UPDATE = "update"
+	OBJECT_CHANGE_DELETE = "delete"
+)
+
+// IsDryRun returns whether a NomadJobGroup is only planned, not applied
+func IsDryRun(spec NomadJobGroupSpec) bool {
+	return spec.DryRun || IsControllerDryRun()
+}
+
+// IsControllerDryRun returns whether NOMAD_GITOPS_DRY_RUN makes the whole controller a dry run
+func IsControllerDryRun() bool {
+	return strings.ToLower(DRY_RUN) == "true"
+}
+
+// NewPlanResult returns the plan of a commit, with the summaries of the jobs that could be planned
+func NewPlanResult(commit string, statuses []*NomadJobStatus, plans []*api.JobPlanResponse) *PlanResult {
+	result := &PlanResult{Commit: commit, PlannedAt: time.Now().Format(time.RFC3339)}
+	for i, status := range statuses {
+		if plans[i] != nil {
+			result.Jobs = append(result.Jobs, SummarizeJobPlan(status.FileName, status.JobName, plans[i]))
+		}
+	}
+	return result
+}
+
+// SummarizeJobPlan describes what registering a job would do: whether the job is created or updated, the changes of
+// its annotated diff, the allocations created, updated or destroyed per group, and the allocations that can't be placed
+func SummarizeJobPlan(file_name string, job_name string, plan *api.JobPlanResponse) JobPlanSummary {
+	summary := JobPlanSummary{FileName: file_name, JobName: job_name, Changes: SummarizeJobDiff(plan.Diff)}
+	if plan.Diff != nil {
+		summary.DiffType = plan.Diff.Type
+	}
+	if plan.Annotations != nil {
+		for _, group := range sortedKeys(plan.Annotations.DesiredTGUpdates) {
+			if updates := summarizeDesiredUpdates(plan.Annotations.DesiredTGUpdates[group]); updates != "" {
+				summary.Updates = append(summary.Updates, "group "+group+": "+updates)
+			}
+		}
+	}
+	for _, group := range sortedKeys(plan.FailedTGAllocs) {
+		summary.PlacementFailures = append(summary.PlacementFailures, "group "+group+": "+summarizePlacementFailure(plan.FailedTGAllocs[group]))
+	}
+	summary.Warnings = plan.Warnings
+	return summary
+}
+
+// summarizeDesiredUpdates lists the allocation changes of a group, in the terms of `nomad job plan`
+func summarizeDesiredUpdates(updates *api.DesiredUpdates) string {
+	if updates == nil {
+		return ""
+	}
+	counts := []struct {
+		count uint64
+		name  string
+	}{
+		{updates.Place, "create"},
+		{updates.Stop, "destroy"},
+		{updates.Migrate, "migrate"},
+		{updates.InPlaceUpdate, "in-place update"},
+		{updates.DestructiveUpdate, "create/destroy update"},
+		{updates.Canary, "canary"},
+		{updates.Preemptions, "preemption"},
+	}
+	parts := []string{}
+	for _, count := range counts {
+		if count.count > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", count.count, count.name))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// summarizePlacementFailure describes why allocations of a group could not be placed, e.g.
+// `failed to place 2 allocations, 3 nodes evaluated, constraint "${attr.kernel.name} = windows" filtered 3 nodes`
+func summarizePlacementFailure(metric *api.AllocationMetric) string {
+	if metric == nil {
+		return "failed to place allocations"
+	}
+	parts := []string{fmt.Sprintf("failed to place %d allocations", metric.CoalescedFailures+1)}
+	if metric.NodesEvaluated == 0 {
+		parts = append(parts, "no nodes were eligible for evaluation")
+	} else {
+		parts = append(parts, fmt.Sprintf("%d nodes evaluated", metric.NodesEvaluated))
+	}
+	for _, class := range sortedKeys(metric.ClassFiltered) {
+		parts = append(parts, fmt.Sprintf("class %q filtered %d nodes", class, metric.ClassFiltered[class]))
+	}
+	for _, constraint := range sortedKeys(metric.ConstraintFiltered) {
+		parts = append(parts, fmt.Sprintf("constraint %q filtered %d nodes", constraint, metric.ConstraintFiltered[constraint]))
+	}
+	for _, dimension := range sortedKeys(metric.DimensionExhausted) {
+		parts = append(parts, fmt.Sprintf("resources exhausted on %d nodes: %s", metric.DimensionExhausted[dimension], dimension))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// PlannedObjectChanges lists the changes to generated objects recorded instead of being applied, ordered by path
+func (discovered DiscoveredObjects) PlannedObjectChanges() (changes []ObjectChange) {
+	for _, path := range sortedKeys(discovered.PlannedChanges) {
+		changes = append(changes, discovered.PlannedChanges[path])
+	}
+	return
+}
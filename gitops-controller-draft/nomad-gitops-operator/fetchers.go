@@ -2,71 +2,47 @@ package main
 
 import (
 	"fmt"
-	"os"
 
-	"github.com/hashicorp/nomad/api"
 	"go.uber.org/zap"
 )
 
-func ExpandVariables(client *api.Client, variablemetadata []*api.VariableMetadata) (variables []api.Variable) {
-	for _, v := range variablemetadata {
-		variable_items, _, err := client.Variables().GetVariableItems(v.Path, &api.QueryOptions{})
+// FetchObjectsWithPrefixes lists the objects under each of the given path prefixes, with their status shards resolved
+func FetchObjectsWithPrefixes(store ObjectStore, prefixes []string) (objects []StoredObject) {
+	for _, prefix := range prefixes {
+		prefix_objects, err := store.List(prefix)
 		if err != nil {
-			logger.Error("failed to fetch variable items from Nomad",
-				zap.String("variablePath", v.Path),
-				zap.String("variableNamespace", v.Namespace),
-				zap.Error(err))
-			os.Exit(1)
-		}
-
-		variable := api.Variable{
-			Namespace:   v.Namespace,
-			Path:        v.Path,
-			CreateTime:  v.CreateTime,
-			CreateIndex: v.CreateIndex,
-			ModifyTime:  v.ModifyTime,
-			ModifyIndex: v.ModifyIndex,
-			Items:       variable_items,
-			Lock:        v.Lock,
+			logger.Error("failed to fetch objects from the object store",
+				zap.String("prefix", prefix),
+				zap.Error(err),
+			)
+			panic(err)
 		}
-		variables = append(variables, variable)
+		objects = append(objects, resolveStatusShards(prefix_objects)...)
 	}
 	return
 }
 
-func FetchNomadJobGroupsForController(client *api.Client) (controller_relevant_nomad_job_objects []NomadJobGroupObject) {
-	variablemetadata, _, err := client.Variables().List(&api.QueryOptions{
-		Prefix: NOMAD_VAR_NOMADJOB_PREFIX,
-	})
-	if err != nil {
-		logger.Error("failed to fetch variablemetadata from Nomad",
-			zap.Error(err),
-		)
-		panic(err)
-	}
-	logger.Info("successfully fetched variables list from Nomad for NomadJobGroups")
+func FetchNomadJobGroupsForController(store ObjectStore) (controller_relevant_nomad_job_objects []NomadJobGroupObject) {
+	objects := FetchObjectsWithPrefixes(store, NOMAD_VAR_NOMADJOB_PREFIXES)
+	logger.Info("successfully fetched objects list for NomadJobGroups")
 
-	variables := ExpandVariables(client, variablemetadata)
-	nomad_job_objects := ConvertVariableToNomadJobGroupStruct(variables)
+	nomad_job_objects := ConvertObjectToNomadJobGroupStruct(objects)
 	controller_relevant_nomad_job_objects = FilterObjectForController(nomad_job_objects)
+	for index := range controller_relevant_nomad_job_objects {
+		RefreshObjectGeneration(store, &controller_relevant_nomad_job_objects[index].ObjectMeta)
+	}
 	return
 }
 
-func FetchGitRepositoriesForController(client *api.Client) (controller_relevant_gitrepo_objects []GitRepositoryObject) {
-	variablemetadata, _, err := client.Variables().List(&api.QueryOptions{
-		Prefix: NOMAD_VAR_GITREPOSITORY_PREFIX,
-	})
-	if err != nil {
-		logger.Error("failed to fetch variablemetadata from Nomad",
-			zap.Error(err),
-		)
-		panic(err)
-	}
-	logger.Info("successfully fetched variables list from Nomad for GitRepositories")
+func FetchGitRepositoriesForController(store ObjectStore) (controller_relevant_gitrepo_objects []GitRepositoryObject) {
+	objects := FetchObjectsWithPrefixes(store, NOMAD_VAR_GITREPOSITORY_PREFIXES)
+	logger.Info("successfully fetched objects list for GitRepositories")
 
-	variables := ExpandVariables(client, variablemetadata)
-	nomad_gitrepo_objects := ConvertVariableToGitRepositoryStruct(variables)
+	nomad_gitrepo_objects := ConvertObjectToGitRepositoryStruct(objects)
 	controller_relevant_gitrepo_objects = FilterObjectForController(nomad_gitrepo_objects)
+	for index := range controller_relevant_gitrepo_objects {
+		RefreshObjectGeneration(store, &controller_relevant_gitrepo_objects[index].ObjectMeta)
+	}
 	return
 }
 
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// Files are selected from a GitRepository in one of two ways:
+//   - legacy: `regex_filter` is matched against the names of the files directly in `path`
+//   - patterns: the directory at `path` (the repository root by default) is walked recursively, and each file is selected
+//     if its repo-relative path matches any `include` pattern and no `exclude` pattern
+//
+// Patterns are globs, where `*` and `?` do not cross directories and `**` matches any number of directories.
+// Globs without a `/` match the file name at any depth, like in .gitignore. Patterns prefixed with `regex:` are
+// regular expressions matched against the repo-relative path instead.
+//
+// In both cases, files ignored by the `.nomadopsignore` file at the root of the repository are never selected.
+const (
+	NOMADOPS_IGNORE_FILE = ".nomadopsignore"
+	REGEX_PATTERN_PREFIX = "regex:"
+)
+
+type pathPattern struct {
+	regex    *regexp.Regexp
+	negated  bool // only used in .nomadopsignore, `!pattern` re-includes previously ignored paths
+	dir_only bool // only used in .nomadopsignore, `pattern/` only matches directories
+}
+
+// compilePathPattern turns a glob or `regex:` pattern into a regular expression matched against repo-relative paths
+func compilePathPattern(pattern string) (*regexp.Regexp, error) {
+	if strings.HasPrefix(pattern, REGEX_PATTERN_PREFIX) {
+		return regexp.Compile(strings.TrimPrefix(pattern, REGEX_PATTERN_PREFIX))
+	}
+
+	anchored := strings.Contains(strings.TrimSuffix(pattern, "/"), "/")
+	pattern = strings.Trim(pattern, "/")
+	expression := strings.Builder{}
+	if anchored {
+		expression.WriteString("^")
+	} else {
+		expression.WriteString("(^|/)")
+	}
+	for i := 0; i < len(pattern); i++ {
+		switch character := pattern[i]; character {
+		case '*':
+			if strings.HasPrefix(pattern[i:], "**/") {
+				expression.WriteString("(.*/)?")
+				i += 2
+			} else if strings.HasPrefix(pattern[i:], "**") {
+				expression.WriteString(".*")
+				i++
+			} else {
+				expression.WriteString("[^/]*")
+			}
+		case '?':
+			expression.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(pattern[i:], ']')
+			if end < 0 {
+				return nil, errors.New("unterminated character class in pattern " + pattern)
+			}
+			class := pattern[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expression.WriteString("[" + class + "]")
+			i += end
+		default:
+			expression.WriteString(regexp.QuoteMeta(string(character)))
+		}
+	}
+	expression.WriteString("$")
+	return regexp.Compile(expression.String())
+}
+
+func compilePathPatterns(patterns []string) (compiled []*regexp.Regexp, err error) {
+	for _, pattern := range patterns {
+		regex, err := compilePathPattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, regex)
+	}
+	return
+}
+
+func matchesAnyPattern(patterns []*regexp.Regexp, relative_path string) bool {
+	for _, pattern := range patterns {
+		if pattern.MatchString(relative_path) {
+			return true
+		}
+	}
+	return false
+}
+
+// readIgnoreFile parses the .nomadopsignore file at the root of a repository, if there is one.
+// It supports a subset of the .gitignore syntax: comments, `!` negation, and trailing `/` for directories.
+func readIgnoreFile(repo_root string) (patterns []pathPattern, err error) {
+	file_contents_bytes, err := os.ReadFile(filepath.Join(repo_root, NOMADOPS_IGNORE_FILE))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(file_contents_bytes), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pattern := pathPattern{}
+		if strings.HasPrefix(line, "!") {
+			pattern.negated = true
+			line = line[1:]
+		}
+		pattern.dir_only = strings.HasSuffix(line, "/")
+		pattern.regex, err = compilePathPattern(line)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, pattern)
+	}
+	return
+}
+
+// isIgnored applies the ignore patterns in order, the last matching pattern wins
+func isIgnored(patterns []pathPattern, relative_path string, is_dir bool) (ignored bool) {
+	for _, pattern := range patterns {
+		if pattern.dir_only && !is_dir {
+			continue
+		}
+		if pattern.regex.MatchString(relative_path) {
+			ignored = !pattern.negated
+		}
+	}
+	return
+}
+
+// isPathIgnored checks a file and all of its parent directories, as files in an ignored directory are ignored too
+func isPathIgnored(patterns []pathPattern, relative_path string) bool {
+	for directory := path.Dir(relative_path); directory != "." && directory != "/"; directory = path.Dir(directory) {
+		if isIgnored(patterns, directory, true) {
+			return true
+		}
+	}
+	return isIgnored(patterns, relative_path, false)
+}
+
+// SelectFilesFromRepository returns the slash-separated, repo-relative paths of the files chosen by the selector, sorted
+func SelectFilesFromRepository(repo_root string, selector FileSelector) (selected_files []string, err error) {
+	ignore_patterns, err := readIgnoreFile(repo_root)
+	if err != nil {
+		return nil, err
+	}
+	exclude_patterns, err := compilePathPatterns(selector.Exclude)
+	if err != nil {
+		return nil, err
+	}
+	selected := func(relative_path string) bool {
+		return !isPathIgnored(ignore_patterns, relative_path) && !matchesAnyPattern(exclude_patterns, relative_path)
+	}
+	directory := filepath.Join(repo_root, selector.Path)
+
+	// Legacy selection, a single directory filtered by file name
+	if len(selector.Include) == 0 {
+		files_in_dir, err := os.ReadDir(directory)
+		if (err != nil) || len(files_in_dir) == 0 {
+			return nil, errors.New("directory is inaccessible or empty")
+		}
+		for _, file := range files_in_dir {
+			relative_path := strings.TrimPrefix(path.Join(filepath.ToSlash(selector.Path), file.Name()), "/")
+			if file.IsDir() || !selected(relative_path) {
+				continue
+			}
+			matches_path_filter, err := regexp.MatchString(selector.RegexFilter, file.Name())
+			if err != nil {
+				logger.Error("regex error when matching path filter to a filename",
+					zap.String("fileName", file.Name()),
+					zap.Error(err),
+				)
+			}
+			if matches_path_filter {
+				logger.Debug("file found matching filter",
+					zap.String("directory", directory),
+					zap.String("regex", selector.RegexFilter),
+					zap.String("fileName", relative_path),
+				)
+				selected_files = append(selected_files, relative_path)
+			}
+		}
+		return selected_files, nil
+	}
+
+	include_patterns, err := compilePathPatterns(selector.Include)
+	if err != nil {
+		return nil, err
+	}
+	err = filepath.WalkDir(directory, func(file_path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relative_path, err := filepath.Rel(repo_root, file_path)
+		if err != nil {
+			return err
+		}
+		relative_path = filepath.ToSlash(relative_path)
+		if entry.IsDir() {
+			if entry.Name() == ".git" || (relative_path != "." && isIgnored(ignore_patterns, relative_path, true)) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if matchesAnyPattern(include_patterns, relative_path) && selected(relative_path) {
+			logger.Debug("file found matching filter",
+				zap.String("directory", directory),
+				zap.Strings("include", selector.Include),
+				zap.String("fileName", relative_path),
+			)
+			selected_files = append(selected_files, relative_path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(selected_files)
+	return selected_files, nil
+}
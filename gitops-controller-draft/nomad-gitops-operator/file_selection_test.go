@@ -0,0 +1,168 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCompilePathPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		matches bool
+	}{
+		{"*.nomad.hcl", "web.nomad.hcl", true},
+		{"*.nomad.hcl", "apps/web/web.nomad.hcl", true},
+		{"*.nomad.hcl", "web.hcl", false},
+		{"apps/*.hcl", "apps/web.hcl", true},
+		{"apps/*.hcl", "apps/web/web.hcl", false},
+		{"apps/*.hcl", "other/apps/web.hcl", false},
+		{"apps/**/*.hcl", "apps/web.hcl", true},
+		{"apps/**/*.hcl", "apps/web/prod/web.hcl", true},
+		{"apps/**", "apps/web/web.hcl", true},
+		{"web?.hcl", "web1.hcl", true},
+		{"web?.hcl", "web/.hcl", false},
+		{"web[0-9].hcl", "web1.hcl", true},
+		{"web[!0-9].hcl", "web1.hcl", false},
+		{"web[!0-9].hcl", "webx.hcl", true},
+		{"web.hcl", "webxhcl", false},
+		{"build/", "build", true},
+		{"build/", "apps/build", true},
+		{"/build", "apps/build", false},
+		{`regex:^apps/.*\.nomad$`, "apps/web/web.nomad", true},
+		{`regex:^apps/.*\.nomad$`, "web.nomad", false},
+	}
+	for _, test := range tests {
+		regex, err := compilePathPattern(test.pattern)
+		if err != nil {
+			t.Fatalf("failed to compile %q: %v", test.pattern, err)
+		}
+		if matches := regex.MatchString(test.path); matches != test.matches {
+			t.Errorf("pattern %q on %q: got %v, want %v", test.pattern, test.path, matches, test.matches)
+		}
+	}
+
+	for _, pattern := range []string{"web[0-9.hcl", "regex:(unclosed"} {
+		if _, err := compilePathPattern(pattern); err == nil {
+			t.Errorf("expected an error for pattern %q", pattern)
+		}
+	}
+}
+
+func TestSelectFilesFromRepository(t *testing.T) {
+	repo_root := t.TempDir()
+	for _, file := range []string{
+		"web.nomad.hcl",
+		"readme.md",
+		"apps/api.nomad.hcl",
+		"apps/api.nomad.hcl.bak",
+		"apps/prod/db.nomad.hcl",
+		"apps/staging/db.nomad.hcl",
+		"vendor/lib.nomad.hcl",
+		"vendor/keep.nomad.hcl",
+		"scratch/tmp.nomad.hcl",
+		".git/config.nomad.hcl",
+	} {
+		full_path := filepath.Join(repo_root, file)
+		if err := os.MkdirAll(filepath.Dir(full_path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(full_path, []byte("job {}"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ignore_file := "# generated files\nscratch/\n*.bak\napps/staging\n"
+	if err := os.WriteFile(filepath.Join(repo_root, NOMADOPS_IGNORE_FILE), []byte(ignore_file), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		selector FileSelector
+		expected []string
+	}{
+		{
+			name:     "legacy regex filter",
+			selector: FileSelector{Path: "apps", RegexFilter: `\.nomad\.hcl`},
+			expected: []string{"apps/api.nomad.hcl"},
+		},
+		{
+			name:     "legacy at the root",
+			selector: FileSelector{RegexFilter: `\.nomad\.hcl$`},
+			expected: []string{"web.nomad.hcl"},
+		},
+		{
+			name:     "include everywhere",
+			selector: FileSelector{Include: []string{"*.nomad.hcl"}},
+			expected: []string{"apps/api.nomad.hcl", "apps/prod/db.nomad.hcl", "vendor/keep.nomad.hcl", "vendor/lib.nomad.hcl", "web.nomad.hcl"},
+		},
+		{
+			name:     "excludes relative to the repository, not the path",
+			selector: FileSelector{Path: "apps", Include: []string{"**/*.hcl"}, Exclude: []string{"prod/*"}},
+			expected: []string{"apps/api.nomad.hcl", "apps/prod/db.nomad.hcl"},
+		},
+		{
+			name:     "excludes",
+			selector: FileSelector{Include: []string{"*.nomad.hcl"}, Exclude: []string{"apps/prod/*", "vendor/**"}},
+			expected: []string{"apps/api.nomad.hcl", "web.nomad.hcl"},
+		},
+		{
+			name:     "regex include",
+			selector: FileSelector{Include: []string{`regex:^apps/[^/]+\.hcl$`}},
+			expected: []string{"apps/api.nomad.hcl"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			selected_files, err := SelectFilesFromRepository(repo_root, test.selector)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(selected_files, test.expected) {
+				t.Fatalf("got %v, want %v", selected_files, test.expected)
+			}
+		})
+	}
+
+	if _, err := SelectFilesFromRepository(repo_root, FileSelector{Path: "missing", RegexFilter: ".*"}); err == nil {
+		t.Fatal("expected an error for a missing directory")
+	}
+}
+
+func TestIsPathIgnored(t *testing.T) {
+	patterns := []pathPattern{}
+	for _, line := range []struct {
+		pattern  string
+		negated  bool
+		dir_only bool
+	}{
+		{"*.log", false, false},
+		{"important.log", true, false},
+		{"tmp/", false, true},
+	} {
+		regex, err := compilePathPattern(line.pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		patterns = append(patterns, pathPattern{regex: regex, negated: line.negated, dir_only: line.dir_only})
+	}
+	tests := []struct {
+		path    string
+		ignored bool
+	}{
+		{"debug.log", true},
+		{"logs/debug.log", true},
+		{"important.log", false},
+		{"tmp/job.hcl", true},
+		{"apps/tmp/job.hcl", true},
+		{"tmp", false}, // a file named like an ignored directory
+		{"apps/job.hcl", false},
+	}
+	for _, test := range tests {
+		if ignored := isPathIgnored(patterns, test.path); ignored != test.ignored {
+			t.Errorf("isPathIgnored(%q) = %v, want %v", test.path, ignored, test.ignored)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/hashicorp/nomad/api"
+)
+
+// Fields of jobs that other systems own, e.g. the counts set by the Nomad Autoscaler, can be left to them with the
+// `ignore_differences` of a NomadJobGroup. Before a job is planned, the ignored fields are copied from the job as it is
+// registered in Nomad, so they neither show up as changes nor are reset when the job is registered for other changes:
+//
+//	"ignore_differences": [
+//	  {"preserve_counts": true},
+//	  {"job": "web", "group": "frontend", "meta_keys": ["scaled_at"]},
+//	  {"task": "nginx", "task_config_paths": ["image", "labels.version"]}
+//	]
+//
+// Like patches, rules apply to all jobs, groups and tasks that match their optional targets. `meta_keys` apply to the
+// most specific level targeted: task, group or job, and `task_config_paths` are dot-separated paths into the driver
+// config of the tasks, which descend into blocks such as `labels {}` of the Docker driver. Rules have no effect on
+// jobs, groups and tasks that are not registered yet, which get the values from their files. A key or path that the
+// registered job doesn't have is removed.
+
+// ApplyIgnoreRules copies the fields ignored by the rules from the registered version of a job, returning whether the
+// counts of all its groups are preserved, so that it can be registered with `PreserveCounts`
+func ApplyIgnoreRules(client *api.Client, job *api.Job, rules []IgnoreRule) (preserve_counts bool, err error) {
+	if len(rules) == 0 {
+		return false, nil
+	}
+	live_job, _, err := client.Jobs().Info(*job.ID, &api.QueryOptions{Namespace: *job.Namespace})
+	response_error := api.UnexpectedResponseError{}
+	if errors.As(err, &response_error) && response_error.StatusCode() == http.StatusNotFound {
+		return false, nil // not registered yet
+	}
+	if err != nil {
+		return false, err
+	}
+
+	for _, rule := range rules {
+		if rule.Job != "" && rule.Job != *job.Name {
+			continue
+		}
+		if rule.Group == "" && rule.Task == "" {
+			job.Meta = copyMetaKeys(job.Meta, live_job.Meta, rule.MetaKeys)
+		}
+		preserve_counts = preserve_counts || (rule.PreserveCounts && rule.Group == "" && rule.Task == "")
+
+		for _, group := range job.TaskGroups {
+			if rule.Group != "" && rule.Group != *group.Name {
+				continue
+			}
+			live_group := live_job.LookupTaskGroup(*group.Name)
+			if live_group == nil {
+				continue
+			}
+			if rule.PreserveCounts {
+				group.Count = live_group.Count
+			}
+			if rule.Task == "" && rule.Group != "" {
+				group.Meta = copyMetaKeys(group.Meta, live_group.Meta, rule.MetaKeys)
+			}
+
+			for _, task := range group.Tasks {
+				if rule.Task != "" && rule.Task != task.Name {
+					continue
+				}
+				var live_task *api.Task
+				for _, candidate := range live_group.Tasks {
+					if candidate.Name == task.Name {
+						live_task = candidate
+					}
+				}
+				if live_task == nil {
+					continue
+				}
+				if rule.Task != "" {
+					task.Meta = copyMetaKeys(task.Meta, live_task.Meta, rule.MetaKeys)
+				}
+				for _, config_path := range rule.TaskConfigPaths {
+					path := strings.Split(config_path, ".")
+					value, exists := getConfigValue(live_task.Config, path)
+					if task.Config == nil {
+						task.Config = map[string]interface{}{}
+					}
+					setConfigValue(task.Config, live_task.Config, path, value, exists)
+				}
+			}
+		}
+	}
+	return
+}
+
+// copyMetaKeys sets the given keys of a meta block to their live values, removing those that are not set live
+func copyMetaKeys(meta map[string]string, live_meta map[string]string, keys []string) map[string]string {
+	for _, key := range keys {
+		live_value, exists := live_meta[key]
+		if !exists {
+			delete(meta, key)
+			continue
+		}
+		if meta == nil {
+			meta = map[string]string{}
+		}
+		meta[key] = live_value
+	}
+	return meta
+}
+
+func getConfigValue(config map[string]interface{}, path []string) (interface{}, bool) {
+	value, exists := config[path[0]]
+	if !exists || len(path) == 1 {
+		return value, exists
+	}
+	nested, is_block := configBlock(value)
+	if !is_block {
+		return nil, false
+	}
+	return getConfigValue(nested, path[1:])
+}
+
+// setConfigValue sets or, if it should not exist, removes the value at the path, creating the blocks along it as
+// needed in the same form as in the live config
+func setConfigValue(config map[string]interface{}, live_config map[string]interface{}, path []string, value interface{}, exists bool) {
+	if len(path) == 1 {
+		if exists {
+			config[path[0]] = value
+		} else {
+			delete(config, path[0])
+		}
+		return
+	}
+	nested, is_block := configBlock(config[path[0]])
+	live_nested, _ := configBlock(live_config[path[0]])
+	if !is_block {
+		if !exists {
+			return
+		}
+		nested = map[string]interface{}{}
+		config[path[0]] = nested
+		if _, is_map := live_config[path[0]].(map[string]interface{}); !is_map {
+			config[path[0]] = []map[string]interface{}{nested}
+		}
+	}
+	setConfigValue(nested, live_nested, path[1:], value, exists)
+}
+
+// configBlock returns the attributes of a nested block of a driver config, such as `labels {}` of the Docker driver,
+// which HCL decodes as a list of one map and registered jobs return as a list of one object
+func configBlock(value interface{}) (map[string]interface{}, bool) {
+	switch block := value.(type) {
+	case map[string]interface{}:
+		return block, true
+	case []map[string]interface{}:
+		if len(block) == 1 {
+			return block[0], true
+		}
+	case []interface{}:
+		if len(block) == 1 {
+			nested, is_map := block[0].(map[string]interface{})
+			return nested, is_map
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGetConfigValue(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   map[string]interface{}
+		path     string
+		expected interface{}
+		exists   bool
+	}{
+		{"top level", map[string]interface{}{"image": "nginx:1.27"}, "image", "nginx:1.27", true},
+		{"missing", map[string]interface{}{"image": "nginx:1.27"}, "command", nil, false},
+		{"nested map", map[string]interface{}{"labels": map[string]interface{}{"version": "1"}}, "labels.version", "1", true},
+		{"block parsed from HCL", map[string]interface{}{"labels": []map[string]interface{}{{"version": "1"}}}, "labels.version", "1", true},
+		{"block of a registered job", map[string]interface{}{"labels": []interface{}{map[string]interface{}{"version": "1"}}}, "labels.version", "1", true},
+		{"repeated blocks", map[string]interface{}{"mount": []interface{}{map[string]interface{}{"type": "bind"}, map[string]interface{}{"type": "volume"}}}, "mount.type", nil, false},
+		{"through a value", map[string]interface{}{"image": "nginx:1.27"}, "image.tag", nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			value, exists := getConfigValue(test.config, strings.Split(test.path, "."))
+			if exists != test.exists || !reflect.DeepEqual(value, test.expected) {
+				t.Fatalf("got %v, %v, want %v, %v", value, exists, test.expected, test.exists)
+			}
+		})
+	}
+}
+
+func TestSetConfigValue(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      map[string]interface{}
+		live_config map[string]interface{}
+		path        string
+		expected    map[string]interface{}
+	}{
+		{
+			name:        "top level",
+			config:      map[string]interface{}{"image": "nginx:1.27"},
+			live_config: map[string]interface{}{"image": "nginx:1.25"},
+			path:        "image",
+			expected:    map[string]interface{}{"image": "nginx:1.25"},
+		},
+		{
+			name:        "removed when not live",
+			config:      map[string]interface{}{"image": "nginx:1.27", "command": "nginx"},
+			live_config: map[string]interface{}{"image": "nginx:1.27"},
+			path:        "command",
+			expected:    map[string]interface{}{"image": "nginx:1.27"},
+		},
+		{
+			name:        "into a block parsed from HCL",
+			config:      map[string]interface{}{"labels": []map[string]interface{}{{"version": "2", "team": "web"}}},
+			live_config: map[string]interface{}{"labels": []interface{}{map[string]interface{}{"version": "1"}}},
+			path:        "labels.version",
+			expected:    map[string]interface{}{"labels": []map[string]interface{}{{"version": "1", "team": "web"}}},
+		},
+		{
+			name:        "block created like the live one",
+			config:      map[string]interface{}{},
+			live_config: map[string]interface{}{"labels": []interface{}{map[string]interface{}{"version": "1"}}},
+			path:        "labels.version",
+			expected:    map[string]interface{}{"labels": []map[string]interface{}{{"version": "1"}}},
+		},
+		{
+			name:        "map created like the live one",
+			config:      map[string]interface{}{},
+			live_config: map[string]interface{}{"labels": map[string]interface{}{"version": "1"}},
+			path:        "labels.version",
+			expected:    map[string]interface{}{"labels": map[string]interface{}{"version": "1"}},
+		},
+		{
+			name:        "nothing created when not live",
+			config:      map[string]interface{}{},
+			live_config: map[string]interface{}{},
+			path:        "labels.version",
+			expected:    map[string]interface{}{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := strings.Split(test.path, ".")
+			value, exists := getConfigValue(test.live_config, path)
+			setConfigValue(test.config, test.live_config, path, value, exists)
+			if !reflect.DeepEqual(test.config, test.expected) {
+				t.Fatalf("got %#v, want %#v", test.config, test.expected)
+			}
+		})
+	}
+}
+
+func TestCopyMetaKeys(t *testing.T) {
+	tests := []struct {
+		name      string
+		meta      map[string]string
+		live_meta map[string]string
+		keys      []string
+		expected  map[string]string
+	}{
+		{"copied", map[string]string{"owner": "web"}, map[string]string{"scaled_at": "now"}, []string{"scaled_at"}, map[string]string{"owner": "web", "scaled_at": "now"}},
+		{"removed when not live", map[string]string{"scaled_at": "then"}, nil, []string{"scaled_at"}, map[string]string{}},
+		{"created", nil, map[string]string{"scaled_at": "now"}, []string{"scaled_at"}, map[string]string{"scaled_at": "now"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			meta := copyMetaKeys(test.meta, test.live_meta, test.keys)
+			if !reflect.DeepEqual(meta, test.expected) {
+				t.Fatalf("got %v, want %v", meta, test.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,36 @@
+//go:build jobspec2
+
+package main
+
+import (
+	"path/filepath"
+
+	"github.com/hashicorp/nomad/api"
+	"github.com/hashicorp/nomad/jobspec2"
+)
+
+// ParseJobHCLLocally parses an HCL2 job specification in-process with Nomad's own jobspec2 package, into the same
+// api.Job as `nomad job run`. Everything the Nomad CLI supports is supported, including `dynamic` blocks, constraint
+// shorthands such as `distinct_hosts` and functions reading files such as `file()`, relative to the job file within
+// the checked out repository.
+//
+// As jobspec2 is part of the BUSL-licensed Nomad module rather than its MPL-licensed `api` module, the local parser is
+// opt-in and only built with `-tags jobspec2`. Other builds use job_hcl_parser_disabled.go instead, so that they don't
+// include any of Nomad's code, and parse jobs through the Nomad API.
+const LOCAL_JOB_PARSER_AVAILABLE = true
+
+func ParseJobHCLLocally(file_contents_bytes []byte, file_name string, repository_path string, variables_file string) (*api.Job, error) {
+	job, err := jobspec2.ParseWithConfig(&jobspec2.ParseConfig{
+		Path:       file_name, // repo-relative, as shown in diagnostics
+		BaseDir:    filepath.Join(repository_path, filepath.Dir(file_name)),
+		Body:       file_contents_bytes,
+		VarContent: variables_file,
+		AllowFS:    true,
+		Strict:     true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	job.Canonicalize()
+	return job, nil
+}
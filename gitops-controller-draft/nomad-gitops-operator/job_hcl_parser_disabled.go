@@ -0,0 +1,18 @@
+//go:build !jobspec2
+
+package main
+
+import (
+	"errors"
+
+	"github.com/hashicorp/nomad/api"
+)
+
+// Without `-tags jobspec2`, jobs are only parsed through the Nomad API, see job_hcl_parser.go
+const LOCAL_JOB_PARSER_AVAILABLE = false
+
+var ErrLocalJobParserUnavailable = errors.New("parsing jobs locally needs a build with `-tags jobspec2`, use NOMAD_GITOPS_JOB_PARSER=api")
+
+func ParseJobHCLLocally(file_contents_bytes []byte, file_name string, repository_path string, variables_file string) (*api.Job, error) {
+	return nil, ErrLocalJobParserUnavailable
+}
@@ -0,0 +1,189 @@
+//go:build jobspec2
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseJobHCLLocallyRepositoryJobs(t *testing.T) {
+	repository_path := filepath.Join("..", "..")
+	tests := []struct {
+		file_name         string
+		job_id            string
+		task_groups       int
+		template_contains string
+	}{
+		{"single-node-setup/deployments/job-traefik.nomad.hcl", "traefik", 1, "[entryPoints"},
+		{"single-node-setup/deployments/job-monitoring.nomad.hcl", "monitoring", 3, "scrape_configs"},
+		{"gitops-controller-draft/manifests/job-nomadops.nomad.hcl", "nomadops", 1, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.file_name, func(t *testing.T) {
+			file_contents_bytes, err := os.ReadFile(filepath.Join(repository_path, test.file_name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			job, err := ParseJobHCLLocally(file_contents_bytes, test.file_name, repository_path, "")
+			if err != nil {
+				t.Fatalf("failed to parse job: %v", err)
+			}
+			if *job.ID != test.job_id || len(job.TaskGroups) != test.task_groups {
+				t.Fatalf("got job %s with %d groups, want %s with %d", *job.ID, len(job.TaskGroups), test.job_id, test.task_groups)
+			}
+			if test.template_contains == "" {
+				return
+			}
+			found := false
+			for _, group := range job.TaskGroups {
+				for _, task := range group.Tasks {
+					for _, template := range task.Templates {
+						found = found || strings.Contains(*template.EmbeddedTmpl, test.template_contains)
+					}
+				}
+			}
+			if !found {
+				t.Fatalf("no template contains %q, file() was not read", test.template_contains)
+			}
+		})
+	}
+}
+
+func TestParseJobHCLLocally(t *testing.T) {
+	tests := []struct {
+		name           string
+		job_hcl        string
+		variables_file string
+		check          func(t *testing.T, job_json string)
+		error_line     int
+	}{
+		{
+			name: "constraint shorthand",
+			job_hcl: `job "app" {
+  group "web" {
+    constraint {
+      distinct_hosts = true
+    }
+    task "nginx" {
+      driver = "docker"
+    }
+  }
+}`,
+			check: func(t *testing.T, job_json string) {
+				if !strings.Contains(job_json, `"Operand":"distinct_hosts"`) {
+					t.Fatalf("distinct_hosts constraint missing: %s", job_json)
+				}
+			},
+		},
+		{
+			name: "dynamic blocks and variables",
+			job_hcl: `variable "ports" {
+  type    = list(string)
+  default = ["http"]
+}
+job "app" {
+  group "web" {
+    network {
+      dynamic "port" {
+        for_each = var.ports
+        labels   = [port.value]
+        content {}
+      }
+    }
+    task "nginx" {
+      driver = "docker"
+      config {
+        image = "nginx:${var.version}"
+      }
+    }
+  }
+}
+variable "version" {
+  type = string
+}`,
+			variables_file: `ports = ["http", "metrics"]` + "\n" + `version = "1.27"`,
+			check: func(t *testing.T, job_json string) {
+				for _, expected := range []string{`"Label":"http"`, `"Label":"metrics"`, `"image":"nginx:1.27"`} {
+					if !strings.Contains(job_json, expected) {
+						t.Fatalf("%s missing: %s", expected, job_json)
+					}
+				}
+			},
+		},
+		{
+			name: "runtime interpolation kept",
+			job_hcl: `job "app" {
+  group "web" {
+    task "nginx" {
+      driver = "docker"
+      env {
+        KERNEL = "${attr.kernel.name}"
+      }
+    }
+  }
+}`,
+			check: func(t *testing.T, job_json string) {
+				if !strings.Contains(job_json, `"KERNEL":"${attr.kernel.name}"`) {
+					t.Fatalf("runtime interpolation not kept: %s", job_json)
+				}
+			},
+		},
+		{
+			name: "unknown attribute",
+			job_hcl: `job "app" {
+  group "web" {
+    cuont = 2
+  }
+}`,
+			error_line: 3,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			job, err := ParseJobHCLLocally([]byte(test.job_hcl), "app.nomad.hcl", t.TempDir(), test.variables_file)
+			if test.error_line != 0 {
+				diagnostics := JobDiagnosticsFromError(err)
+				if len(diagnostics) == 0 || diagnostics[0].Line != test.error_line {
+					t.Fatalf("got diagnostics %+v for error %v, want one on line %d", diagnostics, err, test.error_line)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to parse job: %v", err)
+			}
+			test.check(t, mustMarshalJSON(job))
+		})
+	}
+}
+
+func TestParseJobFileRereadsFiles(t *testing.T) {
+	defer func(job_parser string) { JOB_PARSER = job_parser }(JOB_PARSER)
+	JOB_PARSER = JOB_PARSER_LOCAL
+	repository_path := t.TempDir()
+	job_hcl := []byte(`job "app" {
+  meta {
+    config = file("./config.txt")
+  }
+  group "web" {
+    task "nginx" {
+      driver = "docker"
+    }
+  }
+}`)
+	variables, _ := LoadJobVariables(repository_path, NomadJobGroupSpec{})
+	for _, config := range []string{"first", "second"} {
+		if err := os.WriteFile(filepath.Join(repository_path, "config.txt"), []byte(config), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		job, err := ParseJobFile(nil, repository_path, "commit", "app.nomad.hcl", job_hcl, variables)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.Meta["config"] != config {
+			t.Fatalf("got config %q, want %q from the changed file at the same commit", job.Meta["config"], config)
+		}
+	}
+}
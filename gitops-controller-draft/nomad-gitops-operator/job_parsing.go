@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sync"
+
+	"github.com/hashicorp/nomad/api"
+	"go.uber.org/zap"
+)
+
+// HCL job files are parsed according to NOMAD_GITOPS_JOB_PARSER:
+//   - `api` (default): through the `/v1/jobs/parse` endpoint of the cluster
+//   - `auto`: in-process, falling back to the Nomad API for files the local parser fails on, e.g. HCL1 jobs
+//   - `local`: in-process only, so that no cluster is needed, e.g. to validate a repository in CI
+//
+// The in-process parser is only built with `-tags jobspec2`, see job_hcl_parser.go. Parsed jobs are cached by a hash of
+// the file contents, path, commit and variables, so unchanged files are not parsed again every run. Jobs using functions
+// that read files, such as `file()`, are not cached, as the files they read may change without the job file changing.
+const (
+	JOB_PARSER_AUTO       = "auto"
+	JOB_PARSER_LOCAL      = "local"
+	JOB_PARSER_API        = "api"
+	MAX_PARSED_JOBS_CACHE = 1024
+)
+
+var (
+	parsed_jobs_cache      = map[string][]byte{} // content hash to the JSON of the parsed job
+	parsed_jobs_cache_lock sync.Mutex
+
+	// Calls of the HCL functions reading files, i.e. `file()`, `fileexists()`, `fileset()`, `filebase64()`, `filemd5()`,
+	// ... and `templatefile()`
+	filesystem_function_call_regex = regexp.MustCompile(`(^|[^\w.])(file\w*|templatefile)\s*\(`)
+)
+
+// ParseJobFile turns the contents of a job file into a canonicalized Job.
+// JSON files, i.e. the `api.Job` JSON format with or without the top-level `Job` wrapper, are decoded locally,
+// and everything else is parsed as HCL with the variables of the NomadJobGroup.
+// Files read by HCL functions such as `file()` are looked up relative to the job file within the repository path.
+func ParseJobFile(client *api.Client, repository_path string, commit string, file_name string, file_contents_bytes []byte, job_variables JobVariables) (*api.Job, error) {
+	if IsJSONJobFile(file_name, file_contents_bytes) {
+		return DecodeJSONJob(file_contents_bytes)
+	}
+
+	job_file_variables, err := job_variables.ForJobFile(file_contents_bytes, file_name)
+	if err != nil {
+		return nil, err
+	}
+
+	cache_key := ""
+	if !filesystem_function_call_regex.Match(file_contents_bytes) {
+		hash := sha256.New()
+		fmt.Fprintf(hash, "%s\x00%s\x00%s\x00%s\x00%s\x00%s", JOB_PARSER, repository_path, commit, file_name, file_contents_bytes, job_file_variables)
+		cache_key = hex.EncodeToString(hash.Sum(nil))
+		if job := getCachedJob(cache_key); job != nil {
+			return job, nil
+		}
+	}
+
+	var job *api.Job
+	switch JOB_PARSER {
+	case JOB_PARSER_LOCAL:
+		job, err = ParseJobHCLLocally(file_contents_bytes, file_name, repository_path, job_file_variables)
+	case JOB_PARSER_API:
+		job, err = parseJobHCLWithApi(client, file_contents_bytes, job_file_variables)
+	default:
+		job, err = ParseJobHCLLocally(file_contents_bytes, file_name, repository_path, job_file_variables)
+		if err != nil {
+			logger.Debug("failed to parse job locally, parsing it through the Nomad API instead",
+				zap.String("fileName", file_name),
+				zap.Error(err),
+			)
+			job, err = parseJobHCLWithApi(client, file_contents_bytes, job_file_variables)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if cache_key != "" {
+		setCachedJob(cache_key, job)
+	}
+	return job, nil
+}
+
+func parseJobHCLWithApi(client *api.Client, file_contents_bytes []byte, variables string) (*api.Job, error) {
+	return client.Jobs().ParseHCLOpts(&api.JobsParseRequest{
+		JobHCL:       string(file_contents_bytes),
+		Variables:    variables,
+		Canonicalize: true,
+	})
+}
+
+// getCachedJob returns a copy of a cached job, as jobs are modified after parsing, e.g. by patches
+func getCachedJob(cache_key string) *api.Job {
+	parsed_jobs_cache_lock.Lock()
+	defer parsed_jobs_cache_lock.Unlock()
+	job_json, exists := parsed_jobs_cache[cache_key]
+	if !exists {
+		return nil
+	}
+	job := &api.Job{}
+	if json.Unmarshal(job_json, job) != nil {
+		return nil
+	}
+	return job
+}
+
+func setCachedJob(cache_key string, job *api.Job) {
+	parsed_jobs_cache_lock.Lock()
+	defer parsed_jobs_cache_lock.Unlock()
+	if len(parsed_jobs_cache) >= MAX_PARSED_JOBS_CACHE {
+		parsed_jobs_cache = map[string][]byte{} // simply start over, the cache only needs to cover one reconciliation
+	}
+	parsed_jobs_cache[cache_key] = []byte(mustMarshalJSON(job))
+}
+
+// IsJSONJobFile detects JSON job files by their extension, or by their contents starting with `{` which HCL never does
+func IsJSONJobFile(file_name string, file_contents_bytes []byte) bool {
+	return filepath.Ext(file_name) == ".json" || bytes.HasPrefix(bytes.TrimSpace(file_contents_bytes), []byte("{"))
+}
+
+// DecodeJSONJob decodes and validates a JSON job, rejecting unknown fields so that typos are not silently ignored
+func DecodeJSONJob(file_contents_bytes []byte) (*api.Job, error) {
+	document := map[string]json.RawMessage{}
+	err := json.Unmarshal(file_contents_bytes, &document)
+	if err != nil {
+		return nil, err
+	}
+	if wrapped, is_wrapped := document["Job"]; is_wrapped && len(document) == 1 {
+		file_contents_bytes = wrapped
+	}
+
+	job := &api.Job{}
+	decoder := json.NewDecoder(bytes.NewReader(file_contents_bytes))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(job)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode JSON job: %w", err)
+	}
+
+	if job.ID == nil || *job.ID == "" {
+		job.ID = job.Name
+	}
+	if job.ID == nil || *job.ID == "" {
+		return nil, errors.New("JSON job has neither an ID nor a Name")
+	}
+	if len(job.TaskGroups) == 0 {
+		return nil, errors.New("JSON job has no task groups")
+	}
+	for _, group := range job.TaskGroups {
+		if group.Name == nil || *group.Name == "" {
+			return nil, errors.New("JSON job has a task group without a Name")
+		}
+		if len(group.Tasks) == 0 {
+			return nil, fmt.Errorf("task group %s of JSON job has no tasks", *group.Name)
+		}
+	}
+	job.Canonicalize() // same as the HCL jobs, which are parsed with `Canonicalize: true`
+	return job, nil
+}
@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestFilesystemFunctionCallRegex(t *testing.T) {
+	tests := []struct {
+		job_hcl string
+		matches bool
+	}{
+		{`data = file("./config.toml")`, true},
+		{`data = templatefile("./config.tpl", { port = 80 })`, true},
+		{`data = filebase64 ("./cert.pem")`, true},
+		{`exists = fileexists("./env")`, true},
+		{`data = upper(file("./config.toml"))`, true},
+		{`destination = "local/file.txt"`, false},
+		{`data = local.file("x")`, false},
+		{`data = myfile("./config.toml")`, false},
+	}
+	for _, test := range tests {
+		if matches := filesystem_function_call_regex.MatchString(test.job_hcl); matches != test.matches {
+			t.Errorf("%s: got %v, want %v", test.job_hcl, matches, test.matches)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/hashicorp/hcl/v2/hclparse"
+	"github.com/hashicorp/nomad/api"
+)
+
+// Patch files listed in the `patches` of a NomadJobGroup override fields of the parsed jobs before they are registered,
+// so that one base job specification can serve several environments. Each file holds any number of `patch` blocks:
+//
+//	patch {
+//	  job   = "web"     # optional targets, a patch applies to all jobs, groups and tasks that match
+//	  group = "frontend"
+//	  task  = "nginx"
+//
+//	  count = 3         # task groups, only those with the task if one is targeted
+//	  image = "nginx:1.27"   # tasks, the `image` of the task driver config
+//	  env   = { LOG_LEVEL = "warn" }   # tasks, merged
+//	  meta  = { tier = "prod" }        # merged into the most specific level targeted: task, group or job
+//	  resources { memory = 512 }       # tasks, only the fields that are set
+//	  constraint {                     # added to the most specific level targeted, replacing constraints on the same attribute
+//	    attribute = "$${node.class}"
+//	    value     = "prod"
+//	  }
+//	}
+//
+// Patches are applied in the order of the files and blocks, so later patches win.
+
+type JobPatchFile struct {
+	Patches []JobPatch `hcl:"patch,block"`
+}
+
+type JobPatch struct {
+	Job   string `hcl:"job,optional"`
+	Group string `hcl:"group,optional"`
+	Task  string `hcl:"task,optional"`
+
+	Count       *int               `hcl:"count,optional"`
+	Image       *string            `hcl:"image,optional"`
+	Env         map[string]string  `hcl:"env,optional"`
+	Meta        map[string]string  `hcl:"meta,optional"`
+	Resources   *JobPatchResources `hcl:"resources,block"`
+	Constraints []*api.Constraint  `hcl:"constraint,block"`
+}
+
+type JobPatchResources struct {
+	CPU         *int `hcl:"cpu,optional"`
+	Cores       *int `hcl:"cores,optional"`
+	MemoryMB    *int `hcl:"memory,optional"`
+	MemoryMaxMB *int `hcl:"memory_max,optional"`
+}
+
+type JobPatches struct {
+	patches []JobPatch
+	sources []string // patch file of each patch
+	matched []bool
+}
+
+// LoadJobPatches reads the repo-relative patch files of a NomadJobGroup
+func LoadJobPatches(repo_root string, patch_files []string) (patches JobPatches, err error) {
+	for _, patch_file := range patch_files {
+		file_contents_bytes, err := os.ReadFile(filepath.Join(repo_root, patch_file))
+		if err != nil {
+			return patches, err
+		}
+		patch_hcl, diagnostics := hclparse.NewParser().ParseHCL(file_contents_bytes, patch_file)
+		if diagnostics.HasErrors() {
+			return patches, diagnostics
+		}
+		decoded := JobPatchFile{}
+		diagnostics = gohcl.DecodeBody(patch_hcl.Body, nil, &decoded)
+		if diagnostics.HasErrors() {
+			return patches, diagnostics
+		}
+		for _, patch := range decoded.Patches {
+			for _, constraint := range patch.Constraints {
+				if constraint.Operand == "" {
+					constraint.Operand = "=" // same default as in job specifications
+				}
+			}
+			patches.patches = append(patches.patches, patch)
+			patches.sources = append(patches.sources, patch_file)
+			patches.matched = append(patches.matched, false)
+		}
+	}
+	return
+}
+
+// Apply patches a parsed job in place
+func (patches JobPatches) Apply(job *api.Job) {
+	for index, patch := range patches.patches {
+		if patch.Job != "" && patch.Job != *job.Name {
+			continue
+		}
+		if patch.Group == "" && patch.Task == "" {
+			patches.matched[index] = true
+			job.Meta = mergeStringMaps(job.Meta, patch.Meta)
+			job.Constraints = mergeConstraints(job.Constraints, patch.Constraints)
+		}
+
+		for _, group := range job.TaskGroups {
+			if patch.Group != "" && patch.Group != *group.Name {
+				continue
+			}
+			if patch.Task == "" {
+				patches.matched[index] = true
+				if patch.Count != nil {
+					group.Count = patch.Count
+				}
+			}
+			if patch.Task == "" && patch.Group != "" {
+				group.Meta = mergeStringMaps(group.Meta, patch.Meta)
+				group.Constraints = mergeConstraints(group.Constraints, patch.Constraints)
+			}
+
+			for _, task := range group.Tasks {
+				if patch.Task != "" && patch.Task != task.Name {
+					continue
+				}
+				patches.matched[index] = true
+				if patch.Task != "" && patch.Count != nil {
+					group.Count = patch.Count // only the groups with the targeted task
+				}
+				if patch.Image != nil {
+					if task.Config == nil {
+						task.Config = map[string]interface{}{}
+					}
+					task.Config["image"] = *patch.Image
+				}
+				task.Env = mergeStringMaps(task.Env, patch.Env)
+				if patch.Resources != nil {
+					if task.Resources == nil {
+						task.Resources = &api.Resources{}
+					}
+					task.Resources.CPU = firstNonNil(patch.Resources.CPU, task.Resources.CPU)
+					task.Resources.Cores = firstNonNil(patch.Resources.Cores, task.Resources.Cores)
+					task.Resources.MemoryMB = firstNonNil(patch.Resources.MemoryMB, task.Resources.MemoryMB)
+					task.Resources.MemoryMaxMB = firstNonNil(patch.Resources.MemoryMaxMB, task.Resources.MemoryMaxMB)
+				}
+				if patch.Task != "" {
+					task.Meta = mergeStringMaps(task.Meta, patch.Meta)
+					task.Constraints = mergeConstraints(task.Constraints, patch.Constraints)
+				}
+			}
+		}
+	}
+}
+
+// Unmatched returns a status with a warning for every patch file with patches that did not match any job applied so far
+func (patches JobPatches) Unmatched() (file_warnings []NomadJobStatus) {
+	unmatched_by_source := map[string]int{}
+	sources := []string{}
+	for index, matched := range patches.matched {
+		if !matched {
+			if unmatched_by_source[patches.sources[index]] == 0 {
+				sources = append(sources, patches.sources[index])
+			}
+			unmatched_by_source[patches.sources[index]]++
+		}
+	}
+	for _, source := range sources {
+		file_warnings = append(file_warnings, NomadJobStatus{
+			FileName: source,
+			Warning:  fmt.Sprintf("%d patches did not match any job, group or task", unmatched_by_source[source]),
+		})
+	}
+	return
+}
+
+func mergeStringMaps(base map[string]string, overrides map[string]string) map[string]string {
+	if len(overrides) == 0 {
+		return base
+	}
+	if base == nil {
+		base = map[string]string{}
+	}
+	for key, value := range overrides {
+		base[key] = value
+	}
+	return base
+}
+
+// mergeConstraints adds constraints, replacing existing ones on the same attribute
+func mergeConstraints(base []*api.Constraint, overrides []*api.Constraint) []*api.Constraint {
+	for _, override := range overrides {
+		merged := []*api.Constraint{}
+		for _, constraint := range base {
+			if constraint.LTarget != override.LTarget {
+				merged = append(merged, constraint)
+			}
+		}
+		base = append(merged, override)
+	}
+	return base
+}
+
+func firstNonNil[T any](values ...*T) *T {
+	for _, value := range values {
+		if value != nil {
+			return value
+		}
+	}
+	return nil
+}
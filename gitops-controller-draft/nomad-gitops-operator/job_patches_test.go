@@ -0,0 +1,106 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/nomad/api"
+)
+
+// testPatchedJob returns a job `web` with the groups `frontend` (tasks `nginx` and `sidecar`) and `worker` (task `queue`)
+func testPatchedJob() *api.Job {
+	job := api.NewServiceJob("web", "web", "global", 50)
+	for group_name, task_names := range map[string][]string{"frontend": {"nginx", "sidecar"}, "worker": {"queue"}} {
+		group := api.NewTaskGroup(group_name, 1)
+		for _, task_name := range task_names {
+			group.AddTask(api.NewTask(task_name, "docker").SetConfig("image", task_name+":latest"))
+		}
+		job.AddTaskGroup(group)
+	}
+	return job
+}
+
+func TestJobPatchesApply(t *testing.T) {
+	tests := []struct {
+		name      string
+		patches   string
+		counts    map[string]int    // by group
+		images    map[string]string // by task, if changed
+		unmatched int
+	}{
+		{
+			name:    "count of all groups",
+			patches: `patch { count = 3 }`,
+			counts:  map[string]int{"frontend": 3, "worker": 3},
+		},
+		{
+			name:    "count of a group",
+			patches: "patch {\n group = \"worker\"\n count = 3\n}",
+			counts:  map[string]int{"frontend": 1, "worker": 3},
+		},
+		{
+			name:    "count of the group with the targeted task",
+			patches: "patch {\n task = \"nginx\"\n count = 3\n}",
+			counts:  map[string]int{"frontend": 3, "worker": 1},
+		},
+		{
+			name:    "image of a task",
+			patches: "patch {\n task = \"nginx\"\n image = \"nginx:1.27\"\n}",
+			counts:  map[string]int{"frontend": 1, "worker": 1},
+			images:  map[string]string{"nginx": "nginx:1.27"},
+		},
+		{
+			name:    "later patches win",
+			patches: "patch { count = 2 }\npatch {\n group = \"frontend\"\n count = 4\n}",
+			counts:  map[string]int{"frontend": 4, "worker": 2},
+		},
+		{
+			name:      "other job",
+			patches:   "patch {\n job = \"api\"\n count = 3\n}",
+			counts:    map[string]int{"frontend": 1, "worker": 1},
+			unmatched: 1,
+		},
+		{
+			name:      "missing task",
+			patches:   "patch {\n task = \"missing\"\n count = 3\n}",
+			counts:    map[string]int{"frontend": 1, "worker": 1},
+			unmatched: 1,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			repo_root := t.TempDir()
+			if err := os.WriteFile(filepath.Join(repo_root, "prod.hcl"), []byte(test.patches), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			patches, err := LoadJobPatches(repo_root, []string{"prod.hcl"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			job := testPatchedJob()
+			patches.Apply(job)
+
+			counts := map[string]int{}
+			for _, group := range job.TaskGroups {
+				counts[*group.Name] = *group.Count
+				for _, task := range group.Tasks {
+					expected_image := task.Name + ":latest"
+					if image, exists := test.images[task.Name]; exists {
+						expected_image = image
+					}
+					if task.Config["image"] != expected_image {
+						t.Fatalf("got image %v for task %s, want %s", task.Config["image"], task.Name, expected_image)
+					}
+				}
+			}
+			if !reflect.DeepEqual(counts, test.counts) {
+				t.Fatalf("got counts %v, want %v", counts, test.counts)
+			}
+			if unmatched := patches.Unmatched(); len(unmatched) != test.unmatched {
+				t.Fatalf("got unmatched patch files %v, want %d", unmatched, test.unmatched)
+			}
+		})
+	}
+}
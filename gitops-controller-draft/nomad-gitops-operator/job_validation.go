@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/nomad/api"
+)
+
+// Every parsed job is validated through the `/v1/validate/job` endpoint before it is registered. Parse and validation
+// errors and warnings are reported in the `diagnostics` of the job file's status, with line numbers where known:
+// from the HCL diagnostics of the local parser, or from the error messages of the `/v1/jobs/parse` endpoint.
+const (
+	DIAGNOSTIC_SEVERITY_ERROR   = "error"
+	DIAGNOSTIC_SEVERITY_WARNING = "warning"
+)
+
+// e.g. `input.hcl:12,5-9: Unsupported argument; An argument named "foo" is not expected here.`
+var hclDiagnosticInErrorRegex = regexp.MustCompile(`:(\d+),(\d+)(?:-\d+(?:,\d+)?)?: ([^\n]+)`)
+
+// JobDiagnosticsFromError turns a parse error into diagnostics, one per HCL diagnostic if the error holds any
+func JobDiagnosticsFromError(err error) (diagnostics []JobDiagnostic) {
+	var hcl_diagnostics hcl.Diagnostics
+	if errors.As(err, &hcl_diagnostics) {
+		for _, hcl_diagnostic := range hcl_diagnostics {
+			diagnostic := JobDiagnostic{Severity: DIAGNOSTIC_SEVERITY_ERROR, Message: hcl_diagnostic.Summary}
+			if hcl_diagnostic.Severity == hcl.DiagWarning {
+				diagnostic.Severity = DIAGNOSTIC_SEVERITY_WARNING
+			}
+			if hcl_diagnostic.Detail != "" {
+				diagnostic.Message += "; " + hcl_diagnostic.Detail
+			}
+			if hcl_diagnostic.Subject != nil {
+				diagnostic.Line = hcl_diagnostic.Subject.Start.Line
+				diagnostic.Column = hcl_diagnostic.Subject.Start.Column
+			}
+			diagnostics = append(diagnostics, diagnostic)
+		}
+		return
+	}
+
+	for _, match := range hclDiagnosticInErrorRegex.FindAllStringSubmatch(err.Error(), -1) {
+		line, _ := strconv.Atoi(match[1])
+		column, _ := strconv.Atoi(match[2])
+		diagnostics = append(diagnostics, JobDiagnostic{
+			Severity: DIAGNOSTIC_SEVERITY_ERROR,
+			Message:  strings.TrimSuffix(match[3], ")"), // API errors are wrapped as `Unexpected response code: 500 (...)`
+			Line:     line,
+			Column:   column,
+		})
+	}
+	if len(diagnostics) == 0 {
+		diagnostics = append(diagnostics, JobDiagnostic{Severity: DIAGNOSTIC_SEVERITY_ERROR, Message: err.Error()})
+	}
+	return
+}
+
+// ValidateJob validates a job through the Nomad API, returning its errors and warnings as diagnostics
+func ValidateJob(client *api.Client, job *api.Job) (diagnostics []JobDiagnostic, err error) {
+	response, _, err := client.Jobs().Validate(job, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, validation_error := range response.ValidationErrors {
+		diagnostics = append(diagnostics, JobDiagnostic{Severity: DIAGNOSTIC_SEVERITY_ERROR, Message: validation_error})
+	}
+	if len(response.ValidationErrors) == 0 && response.Error != "" {
+		diagnostics = append(diagnostics, JobDiagnostic{Severity: DIAGNOSTIC_SEVERITY_ERROR, Message: response.Error})
+	}
+	for _, warning := range splitMultiErrorList(response.Warnings) {
+		diagnostics = append(diagnostics, JobDiagnostic{Severity: DIAGNOSTIC_SEVERITY_WARNING, Message: warning})
+	}
+	return
+}
+
+// firstErrorDiagnostic returns the message of the first error diagnostic, if there is one
+func firstErrorDiagnostic(diagnostics []JobDiagnostic) (string, bool) {
+	for _, diagnostic := range diagnostics {
+		if diagnostic.Severity == DIAGNOSTIC_SEVERITY_ERROR {
+			return diagnostic.Message, true
+		}
+	}
+	return "", false
+}
+
+// splitMultiErrorList splits the `* item` lists Nomad formats warnings as, e.g. "1 warning:\n\n* Group uses ..."
+func splitMultiErrorList(text string) (items []string) {
+	for _, line := range strings.Split(text, "\n") {
+		if item, is_item := strings.CutPrefix(strings.TrimSpace(line), "* "); is_item {
+			items = append(items, item)
+		}
+	}
+	if len(items) == 0 && strings.TrimSpace(text) != "" {
+		items = append(items, strings.TrimSpace(text))
+	}
+	return
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclparse"
+)
+
+// HCL2 input variables of the job specifications of a NomadJobGroup are set from its `var_files` (repo-relative, later
+// files taking precedence) and its inline `variables`, which take precedence over all files. Each job file is only passed
+// the variables it declares, so a single set of values can be shared by all jobs of the group.
+const INLINE_VARIABLES_SOURCE = "spec.variables"
+
+type JobVariables struct {
+	values  map[string]string // variable name to its value, as HCL expression source
+	sources map[string]string // variable name to the var file it was set in, or INLINE_VARIABLES_SOURCE
+	used    map[string]bool
+}
+
+// LoadJobVariables reads the variable values of a NomadJobGroup, returning a status for every var file that failed to load
+func LoadJobVariables(repo_root string, spec NomadJobGroupSpec) (variables JobVariables, file_errors []NomadJobStatus) {
+	variables = JobVariables{values: map[string]string{}, sources: map[string]string{}, used: map[string]bool{}}
+
+	for _, var_file := range spec.VarFiles {
+		file_contents_bytes, err := os.ReadFile(filepath.Join(repo_root, var_file))
+		if err != nil {
+			file_errors = append(file_errors, NomadJobStatus{FileName: var_file, Error: err.Error()})
+			continue
+		}
+		var_file_hcl, diagnostics := hclparse.NewParser().ParseHCL(file_contents_bytes, var_file)
+		if diagnostics.HasErrors() {
+			file_errors = append(file_errors, NomadJobStatus{FileName: var_file, Error: diagnostics.Error()})
+			continue
+		}
+		attributes, diagnostics := var_file_hcl.Body.JustAttributes()
+		if diagnostics.HasErrors() {
+			file_errors = append(file_errors, NomadJobStatus{FileName: var_file, Error: diagnostics.Error()})
+			continue
+		}
+		for name, attribute := range attributes {
+			variables.values[name] = string(attribute.Expr.Range().SliceBytes(file_contents_bytes))
+			variables.sources[name] = var_file
+		}
+	}
+
+	for name, value := range spec.Variables {
+		// JSON values are valid HCL expressions, only template sequences in strings need escaping
+		var compact bytes.Buffer
+		json.Compact(&compact, value)
+		expression := strings.NewReplacer("${", "$${", "%{", "%%{").Replace(compact.String())
+		variables.values[name] = expression
+		variables.sources[name] = INLINE_VARIABLES_SOURCE
+	}
+	return
+}
+
+// ForJobFile returns the contents of a variables file with the values declared by the given job specification.
+// Declared variables without a default and without a value are returned as an error.
+func (variables JobVariables) ForJobFile(file_contents_bytes []byte, file_name string) (string, error) {
+	declared, err := declaredJobVariables(file_contents_bytes, file_name)
+	if err != nil {
+		// Not valid HCL2, e.g. an HCL1 job - pass everything and leave the error reporting to Nomad
+		for name := range variables.values {
+			variables.used[name] = true
+		}
+		return variables.render(func(string) bool { return true }), nil
+	}
+
+	missing := []string{}
+	for name, has_default := range declared {
+		variables.used[name] = true
+		if _, is_set := variables.values[name]; !is_set && !has_default {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return "", fmt.Errorf("no value set for variables without a default: %s", strings.Join(missing, ", "))
+	}
+	return variables.render(func(name string) bool { _, is_declared := declared[name]; return is_declared }), nil
+}
+
+// Unused returns a status with a warning for every var file or inline value setting variables not declared by any job
+// file seen so far
+func (variables JobVariables) Unused() (file_warnings []NomadJobStatus) {
+	unused_by_source := map[string][]string{}
+	for name, source := range variables.sources {
+		if !variables.used[name] {
+			unused_by_source[source] = append(unused_by_source[source], name)
+		}
+	}
+	for source, names := range unused_by_source {
+		sort.Strings(names)
+		file_warnings = append(file_warnings, NomadJobStatus{
+			FileName: source,
+			Warning:  "variables set but not declared by any job file: " + strings.Join(names, ", "),
+		})
+	}
+	sort.Slice(file_warnings, func(i, j int) bool { return file_warnings[i].FileName < file_warnings[j].FileName })
+	return
+}
+
+func (variables JobVariables) render(include func(name string) bool) string {
+	names := []string{}
+	for name := range variables.values {
+		if include(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	rendered := strings.Builder{}
+	for _, name := range names {
+		fmt.Fprintf(&rendered, "%s = %s\n", name, variables.values[name])
+	}
+	return rendered.String()
+}
+
+// declaredJobVariables returns the variables declared in an HCL2 job specification, and whether each has a default
+func declaredJobVariables(file_contents_bytes []byte, file_name string) (declared map[string]bool, err error) {
+	job_hcl, diagnostics := hclparse.NewParser().ParseHCL(file_contents_bytes, file_name)
+	if diagnostics.HasErrors() {
+		return nil, diagnostics
+	}
+	content, _, diagnostics := job_hcl.Body.PartialContent(&hcl.BodySchema{
+		Blocks: []hcl.BlockHeaderSchema{{Type: "variable", LabelNames: []string{"name"}}},
+	})
+	if diagnostics.HasErrors() {
+		return nil, diagnostics
+	}
+
+	declared = map[string]bool{}
+	for _, block := range content.Blocks {
+		variable_content, _, diagnostics := block.Body.PartialContent(&hcl.BodySchema{
+			Attributes: []hcl.AttributeSchema{{Name: "default"}},
+		})
+		if diagnostics.HasErrors() {
+			return nil, diagnostics
+		}
+		_, has_default := variable_content.Attributes["default"]
+		declared[block.Labels[0]] = has_default
+	}
+	return
+}
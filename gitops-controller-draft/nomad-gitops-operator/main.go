@@ -1,8 +1,10 @@
 package main
 
 import (
+	"flag"
 	"os"
 	"strings"
+	"sync"
 
 	"github.com/hashicorp/nomad/api"
 	"github.com/robfig/cron/v3"
@@ -16,14 +18,28 @@ var (
 	ONE_OFF              string
 	controller_name      string
 	controller_namespace string
+	OBJECT_STORE_BACKEND string
+	OBJECT_STORE_PATH    string
+	WATCH_OBJECT_STORE   string
+	JOB_PARSER           string
+	DEPLOYMENT_TIMEOUT   string
+	DRY_RUN              string
+	PROMETHEUS_ADDRESS   string
+	SYNC_WINDOWS         string
+	API_ADDRESS          string
+	API_TOKEN            string
+	API_APPROVER_TOKENS  string
 
 	// Internally configurable vars
-	NOMAD_VAR_NOMADJOB_PREFIX      = "nomadops/v1/nomadjobgroup/"
-	NOMAD_VAR_GITREPOSITORY_PREFIX = "nomadops/v1/gitrepository/"
+	NOMAD_VAR_PREFIX                 = "nomadops/"
+	NOMAD_VAR_PATH_VERSIONS          = []string{"v1", "v2"} // objects are read from the paths of all versions, whatever their `api_version`
+	NOMAD_VAR_NOMADJOB_PREFIXES      = GetVariablePathPrefixes("nomadjobgroup")
+	NOMAD_VAR_GITREPOSITORY_PREFIXES = GetVariablePathPrefixes("gitrepository")
 
 	// Derived internal vars
 	controller_git_clone_base_path string
 	logger                         = zap.L()
+	reconciliation_lock            sync.Mutex
 )
 
 func init() {
@@ -41,6 +57,23 @@ func init() {
 	ONE_OFF = GetEnv("NOMAD_GITOPS_ONE_OFF", "false")
 	controller_name = GetEnv("NOMAD_GITOPS_CONTROLLER_NAME", "nomadops")
 	controller_namespace = GetEnv("NOMAD_GITOPS_CONTROLLER_NAMESPACE", "default")
+	OBJECT_STORE_BACKEND = GetEnv("NOMAD_GITOPS_OBJECT_STORE", "nomad-variables")
+	OBJECT_STORE_PATH = GetEnv("NOMAD_GITOPS_OBJECT_STORE_PATH", "manifests") // only used by the `file` object store
+	WATCH_OBJECT_STORE = GetEnv("NOMAD_GITOPS_WATCH_OBJECT_STORE", "true")
+	JOB_PARSER = GetEnv("NOMAD_GITOPS_JOB_PARSER", "api")                  // `api`, `auto` or `local`, see job_parsing.go
+	PROMETHEUS_ADDRESS = GetEnv("NOMAD_GITOPS_PROMETHEUS_ADDRESS", "")     // default for the canary checks of NomadJobGroups
+	SYNC_WINDOWS = GetEnv("NOMAD_GITOPS_SYNC_WINDOWS", "")                 // JSON list of sync windows for all NomadJobGroups, see sync_window.go
+	API_ADDRESS = GetEnv("NOMAD_GITOPS_API_ADDRESS", "")                   // e.g. `:8080`, the API is disabled if empty, see api_server.go
+	API_TOKEN = GetSecretEnv("NOMAD_GITOPS_API_TOKEN")                     // bearer token required by the API, if set
+	API_APPROVER_TOKENS = GetSecretEnv("NOMAD_GITOPS_API_APPROVER_TOKENS") // JSON map of approver names to their tokens, enables approvals through the API
+	DEPLOYMENT_TIMEOUT = GetEnv("NOMAD_GITOPS_DEPLOYMENT_TIMEOUT", "0s")   // default for the `deployment_timeout` of NomadJobGroups, 0s for no limit
+	DRY_RUN = GetEnv("NOMAD_GITOPS_DRY_RUN", "false")                      // only plan the jobs of all NomadJobGroups, see dry_run.go
+
+	if JOB_PARSER != JOB_PARSER_API && !LOCAL_JOB_PARSER_AVAILABLE {
+		logger.Warn("this build has no local job parser, build with `-tags jobspec2` to use it",
+			zap.String("jobParser", JOB_PARSER),
+		)
+	}
 
 	// Set up derived internal vars
 	controller_git_clone_base_path = "/local/tmp/nomad/" + controller_name
@@ -59,19 +92,45 @@ func main() {
 	// Set up Nomad ClientConfig for all controllers to use
 	// This uses the same env vars as the Nomad CLI, so set `env` block in the Nomad job spec accordingly
 	client := InitializeNomadApiClient(api.DefaultConfig())
+	store := InitializeObjectStore(client)
+
+	// Subcommands - `migrate` rewrites stored objects to the latest api_version and exits
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		migrate_flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+		dry_run := migrate_flags.Bool("dry-run", false, "only log the objects that would be migrated")
+		migrate_flags.Parse(os.Args[2:])
+		RunMigration(store, *dry_run)
+		return
+	}
 
 	// Run the controllers - usually with cron, unless ONE_OFF is set
 	if strings.ToLower(ONE_OFF) == "true" {
-		ControllerGitRepository(client)
-		ControllerNomadJobGroup(client)
+		RunReconciliation(client, store)
 	} else {
 		c := cron.New(cron.WithSeconds())
 		c.AddFunc(SYNC_INTERVAL_CRON, func() {
-			logger.Info("starting reconciliation loop")
-			ControllerGitRepository(client)
-			ControllerNomadJobGroup(client)
+			RunReconciliation(client, store)
 		})
 		c.Start()
+		if API_ADDRESS != "" {
+			go ServeApi(store)
+		}
+		if strings.ToLower(WATCH_OBJECT_STORE) == "true" {
+			go WatchObjectStore(store, func() { RunReconciliation(client, store) })
+		}
 		select {} // Keeps program running forever
 	}
 }
+
+// RunReconciliation runs all controllers once, skipping the run if a previous one is still in progress
+func RunReconciliation(client *api.Client, store ObjectStore) {
+	if !reconciliation_lock.TryLock() {
+		logger.Warn("skipping reconciliation loop as the previous one is still running")
+		return
+	}
+	defer reconciliation_lock.Unlock()
+
+	logger.Info("starting reconciliation loop")
+	ControllerGitRepository(store)
+	ControllerNomadJobGroup(client, store)
+}
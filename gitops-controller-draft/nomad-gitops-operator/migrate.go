@@ -0,0 +1,116 @@
+package main
+
+import (
+	"maps"
+
+	"go.uber.org/zap"
+)
+
+// RunMigration rewrites the stored objects of this controller to the latest api_version.
+// Objects are rewritten in place, keeping their path so that references between objects stay valid.
+// Objects are read as they are stored rather than through the controllers' fetchers, so that objects in older formats
+// are migrated even where the controllers would skip them, and objects that can't be decoded are reported.
+func RunMigration(store ObjectStore, dry_run bool) {
+	logger.Info("starting migration",
+		zap.String("targetApiVersion", OBJECT_API_VERSION_LATEST),
+		zap.Bool("dryRun", dry_run),
+	)
+
+	migrated_objects := 0
+	failed_objects := 0
+	count := func(migrated bool, ok bool) {
+		if migrated {
+			migrated_objects++
+		}
+		if !ok {
+			failed_objects++
+		}
+	}
+	for _, object := range FetchObjectsWithPrefixes(store, NOMAD_VAR_GITREPOSITORY_PREFIXES) {
+		repo := GitRepositoryObject{}
+		count(migrateStoredObject(store, object, OBJECT_KIND_GIT_REPOSITORY, &repo.Spec, &repo.Status, dry_run))
+	}
+	for _, object := range FetchObjectsWithPrefixes(store, NOMAD_VAR_NOMADJOB_PREFIXES) {
+		job := NomadJobGroupObject{}
+		count(migrateStoredObject(store, object, OBJECT_KIND_NOMAD_JOB_GROUP, &job.Spec, &job.Status, dry_run))
+	}
+
+	logger.Info("migration complete",
+		zap.Int("migratedObjects", migrated_objects),
+		zap.Int("failedObjects", failed_objects),
+		zap.Bool("dryRun", dry_run),
+	)
+}
+
+// migrateStoredObject rewrites a single object of this controller, returning whether it was (or would be) migrated and
+// false for ok if it failed
+func migrateStoredObject(store ObjectStore, stored StoredObject, kind string, spec interface{}, status interface{}, dry_run bool) (migrated bool, ok bool) {
+	meta, err := decodeStoredObject(stored, kind, spec, status)
+	if err != nil {
+		logger.Error("failed to decode object, not migrating it",
+			zap.String("variablePath", stored.Path),
+			zap.Error(err),
+		)
+		return false, false
+	}
+	if meta.ControllerName != controller_name || meta.Namespace != controller_namespace {
+		return false, true
+	}
+	if meta.ApiVersion == OBJECT_API_VERSION_LATEST {
+		return false, true
+	}
+
+	object := stored
+	object.Items = maps.Clone(stored.Items)
+	if meta.ApiVersion == OBJECT_API_VERSION_FLAT {
+		// Flat objects have their fields as items of their own, which are replaced by the v2 items
+		object.Items = map[string]string{
+			"kind":            meta.Kind,
+			"controller_name": meta.ControllerName,
+			"status":          mustMarshalJSON(status),
+		}
+		for _, key := range []string{"generation", "spec_hash"} {
+			if stored.Items[key] != "" {
+				object.Items[key] = stored.Items[key]
+			}
+		}
+	}
+	// Status and generation are shared by all versions, only the spec document needs converting
+	object.Items["api_version"] = OBJECT_API_VERSION_LATEST
+	object.Items["spec"] = encodeSpecDocument(OBJECT_API_VERSION_LATEST, spec)
+	if object.Items["spec_hash"] != "" {
+		object.Items["spec_hash"] = hashUserOwnedItems(object.Items) // the spec is the same, so keep its generation
+	}
+
+	if dry_run {
+		logger.Info("dry-run: would migrate object",
+			zap.String("variablePath", meta.Path),
+			zap.String("fromApiVersion", meta.ApiVersion),
+			zap.String("toApiVersion", OBJECT_API_VERSION_LATEST),
+			zap.Any("currentItems", stored.Items),
+			zap.String("migratedSpec", object.Items["spec"]),
+		)
+		return true, true
+	}
+
+	if meta.ApiVersion == OBJECT_API_VERSION_FLAT {
+		err = writeStatusItem(store, &object, status) // compressed or sharded if needed, like any status update
+	}
+	if err == nil {
+		// Checked update, so that objects modified since they were read are not overwritten
+		err = store.Put(&object)
+	}
+	if err != nil {
+		logger.Error("failed to migrate object",
+			zap.String("variablePath", meta.Path),
+			zap.Error(err),
+		)
+		return false, false
+	}
+	logger.Info("migrated object",
+		zap.String("variablePath", meta.Path),
+		zap.String("fromApiVersion", meta.ApiVersion),
+		zap.String("toApiVersion", OBJECT_API_VERSION_LATEST),
+	)
+	return true, true
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"github.com/hashicorp/nomad/api"
+	"go.uber.org/zap"
+)
+
+// Objects created by a NomadJobGroup from definition files in its repository record their owner (`owner_path`) and
+// the repo-relative file they were defined in (`owner_source_file`). They are garbage collected once that file no
+// longer defines them, or once their owner is deleted, cascading down to the objects they own in turn.
+
+// DiscoveredObjects tracks what a NomadJobGroup defined in its repository during one reconciliation
+type DiscoveredObjects struct {
+	Paths             map[string]bool         // objects applied from definition files
+	FailedSourceFiles map[string]bool         // files that could not be read or parsed, their objects are kept as they are
+	PlannedChanges    map[string]ObjectChange // changes not applied as the owner is a dry run, by path, see dry_run.go
+}
+
+func NewDiscoveredObjects() DiscoveredObjects {
+	return DiscoveredObjects{Paths: map[string]bool{}, FailedSourceFiles: map[string]bool{}, PlannedChanges: map[string]ObjectChange{}}
+}
+
+// WouldCreateOwnershipCycle checks whether the object is the owner itself or one of the owner's ancestors
+func WouldCreateOwnershipCycle(store ObjectStore, owner_path string, object_path string) bool {
+	visited := map[string]bool{}
+	for path := owner_path; path != ""; {
+		if path == object_path || visited[path] {
+			return true
+		}
+		visited[path] = true
+		owner, err := store.Get(path)
+		if err != nil || owner == nil {
+			return false
+		}
+		path = owner.Items["owner_path"]
+	}
+	return false
+}
+
+// fetchAllObjectsForController lists objects of every kind that belong to this controller
+func fetchAllObjectsForController(store ObjectStore) (objects []StoredObject) {
+	prefixes := append(append([]string{}, NOMAD_VAR_NOMADJOB_PREFIXES...), NOMAD_VAR_GITREPOSITORY_PREFIXES...)
+	for _, object := range FetchObjectsWithPrefixes(store, prefixes) {
+		if object.Items["controller_name"] == controller_name && object.Namespace == controller_namespace {
+			objects = append(objects, object)
+		}
+	}
+	return
+}
+
+// GarbageCollectOwnedObjects deletes the objects owned by a NomadJobGroup that its repository no longer defines
+func GarbageCollectOwnedObjects(client *api.Client, store ObjectStore, job NomadJobGroupObject, discovered DiscoveredObjects) (deleted_paths []string) {
+	for _, object := range fetchAllObjectsForController(store) {
+		if object.Items["owner_path"] != job.Path || discovered.Paths[object.Path] || discovered.FailedSourceFiles[object.Items["owner_source_file"]] {
+			continue
+		}
+		if IsDryRun(job.Spec) {
+			discovered.PlannedChanges[object.Path] = ObjectChange{
+				Path:       object.Path,
+				Kind:       object.Items["kind"],
+				Change:     OBJECT_CHANGE_DELETE,
+				SourceFile: object.Items["owner_source_file"],
+			}
+			continue
+		}
+		logger.Info("garbage collecting object no longer defined in its owner's repository",
+			zap.String("variablePath", object.Path),
+			zap.String("ownerPath", job.Path),
+			zap.String("sourceFile", object.Items["owner_source_file"]),
+		)
+		if deleteOwnedObject(client, store, object) {
+			deleted_paths = append(deleted_paths, object.Path)
+		}
+	}
+	return
+}
+
+// GarbageCollectOrphanedObjects deletes objects whose owner no longer exists, repeating until no orphans are left so
+// that deletion cascades through every level of ownership. Objects owning each other in a cycle are never orphaned.
+func GarbageCollectOrphanedObjects(client *api.Client, store ObjectStore) (deleted_paths []string) {
+	failed_paths := map[string]bool{}
+	for {
+		objects := fetchAllObjectsForController(store)
+		existing_paths := map[string]bool{}
+		for _, object := range objects {
+			existing_paths[object.Path] = true
+		}
+
+		deleted_any := false
+		for _, object := range objects {
+			owner_path := object.Items["owner_path"]
+			if owner_path == "" || existing_paths[owner_path] || failed_paths[object.Path] {
+				continue
+			}
+			if IsControllerDryRun() {
+				logger.Info("dry-run: would garbage collect object as its owner no longer exists",
+					zap.String("variablePath", object.Path),
+					zap.String("ownerPath", owner_path),
+				)
+				continue
+			}
+			logger.Info("garbage collecting object as its owner no longer exists",
+				zap.String("variablePath", object.Path),
+				zap.String("ownerPath", owner_path),
+			)
+			if deleteOwnedObject(client, store, object) {
+				deleted_paths = append(deleted_paths, object.Path)
+				deleted_any = true
+			} else {
+				failed_paths[object.Path] = true
+			}
+		}
+		if !deleted_any {
+			return
+		}
+	}
+}
+
+// deleteOwnedObject removes an object with its status shards, deregistering its jobs first if it is a pruning NomadJobGroup
+func deleteOwnedObject(client *api.Client, store ObjectStore, object StoredObject) bool {
+	if object.Items["kind"] == OBJECT_KIND_NOMAD_JOB_GROUP {
+		job := NomadJobGroupObject{}
+		_, err := decodeStoredObject(object, OBJECT_KIND_NOMAD_JOB_GROUP, &job.Spec, &job.Status)
+		if err == nil && job.Spec.Prune && IsDryRun(job.Spec) {
+			logger.Info("not pruning jobs of deleted NomadJobGroup, as it is a dry run",
+				zap.String("nomadJobGroup", object.Path),
+			)
+		} else if err == nil && job.Spec.Prune {
+			PruneJobsOfNomadJobGroup(client, object.Path)
+		}
+	}
+
+	err := store.Delete(object.Path, object.ModifyIndex)
+	if err == nil {
+		err = deleteStatusShards(store, object.Path, 0)
+	}
+	if err != nil {
+		logger.Error("failed to delete object",
+			zap.String("variablePath", object.Path),
+			zap.Error(err),
+		)
+		return false
+	}
+	return true
+}
+
+// PruneJobsOfNomadJobGroup deregisters all jobs this controller registered for the given NomadJobGroup
+func PruneJobsOfNomadJobGroup(client *api.Client, nomad_job_group_path string) {
+	jobs, _, err := client.Jobs().ListOptions(&api.JobListOptions{Fields: &api.JobListFields{Meta: true}}, &api.QueryOptions{})
+	if err != nil {
+		logger.Error("failed to list jobs to prune",
+			zap.String("nomadJobGroup", nomad_job_group_path),
+			zap.Error(err),
+		)
+		return
+	}
+	for _, job := range jobs {
+		if job.Meta["nomad_gitops_nomad_job_group"] != nomad_job_group_path || job.Meta["nomad_gitops_controller_name"] != controller_name {
+			continue
+		}
+		_, _, err := client.Jobs().Deregister(job.ID, false, &api.WriteOptions{Namespace: job.Namespace})
+		if err != nil {
+			logger.Error("failed to prune job",
+				zap.String("jobName", job.Name),
+				zap.String("nomadJobGroup", nomad_job_group_path),
+				zap.Error(err),
+			)
+			continue
+		}
+		logger.Info("pruned job of deleted NomadJobGroup",
+			zap.String("jobName", job.Name),
+			zap.String("nomadJobGroup", nomad_job_group_path),
+		)
+	}
+}
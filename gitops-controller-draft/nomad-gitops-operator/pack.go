@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclparse"
+	"github.com/zclconf/go-cty/cty"
+	ctyjson "github.com/zclconf/go-cty/cty/json"
+)
+
+// Nomad Packs are rendered in-process, without the `nomad-pack` binary. A pack is a directory with:
+//   - metadata.hcl: the `app` and `pack` blocks, available to templates through `meta`
+//   - variables.hcl: `variable` blocks with their defaults, set from the values files of the NomadJobGroup
+//   - templates/*.nomad.tpl: job specifications, Go templates with `[[ ]]` delimiters
+//   - templates/_*.tpl: helper templates, only used through `template`
+//
+// Both the current (`[[ var "name" . ]]`, `[[ meta "pack.name" . ]]`) and the older (`[[ .my_pack.name ]]`) template
+// syntax are supported. Packs with dependencies are not supported.
+const (
+	PACK_METADATA_FILE       = "metadata.hcl"
+	PACK_VARIABLES_FILE      = "variables.hcl"
+	PACK_TEMPLATES_DIR       = "templates"
+	PACK_JOB_TEMPLATE_SUFFIX = ".nomad.tpl"
+)
+
+// RenderPack renders the job templates of a pack, returning the job specifications by repo-relative template path
+func RenderPack(repo_root string, source PackSource) (rendered map[string][]byte, err error) {
+	pack_directory := filepath.Join(repo_root, source.Path)
+
+	metadata, err := readPackMetadata(filepath.Join(pack_directory, PACK_METADATA_FILE))
+	if err != nil {
+		return nil, err
+	}
+	pack_name := metadata["pack.name"]
+	if pack_name == "" {
+		pack_name = path.Base(source.Path)
+	}
+
+	variables, err := readPackVariables(filepath.Join(pack_directory, PACK_VARIABLES_FILE))
+	if err != nil {
+		return nil, err
+	}
+	for _, values_file := range source.ValuesFiles {
+		values, err := readHCLAttributeValues(filepath.Join(repo_root, values_file))
+		if err != nil {
+			return nil, err
+		}
+		for name, value := range values {
+			if _, declared := variables[name]; !declared {
+				return nil, fmt.Errorf("%s sets variable %q, which is not declared by the pack", values_file, name)
+			}
+			variables[name] = value
+		}
+	}
+
+	pack_metadata := map[string]interface{}{}
+	for key, value := range metadata {
+		if name, is_pack_key := strings.CutPrefix(key, "pack."); is_pack_key {
+			pack_metadata[name] = value
+		}
+	}
+	data := map[string]interface{}{
+		pack_name:    variables,
+		"nomad_pack": map[string]interface{}{"pack": pack_metadata},
+	}
+
+	templates := template.New(pack_name).Delims("[[", "]]").Option("missingkey=zero").Funcs(packTemplateFunctions(variables, metadata))
+	template_names := []string{}
+	err = filepath.WalkDir(filepath.Join(pack_directory, PACK_TEMPLATES_DIR), func(file_path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || filepath.Ext(file_path) != ".tpl" {
+			return err
+		}
+		file_contents_bytes, err := os.ReadFile(file_path)
+		if err != nil {
+			return err
+		}
+		_, err = templates.New(entry.Name()).Parse(string(file_contents_bytes))
+		if err != nil {
+			return err
+		}
+		if strings.HasSuffix(entry.Name(), PACK_JOB_TEMPLATE_SUFFIX) && !strings.HasPrefix(entry.Name(), "_") {
+			template_names = append(template_names, entry.Name())
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(template_names) == 0 {
+		return nil, errors.New("pack has no job templates in " + path.Join(source.Path, PACK_TEMPLATES_DIR))
+	}
+
+	rendered = map[string][]byte{}
+	sort.Strings(template_names)
+	for _, template_name := range template_names {
+		var output bytes.Buffer
+		err = templates.ExecuteTemplate(&output, template_name, data)
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(output.String()) == "" {
+			continue // e.g. a job that is disabled through a variable
+		}
+		rendered[path.Join(source.Path, PACK_TEMPLATES_DIR, template_name)] = output.Bytes()
+	}
+	return
+}
+
+// readPackMetadata flattens the blocks of metadata.hcl, e.g. `pack { name = "x" }` becomes `pack.name`
+func readPackMetadata(file_path string) (metadata map[string]string, err error) {
+	body, file_contents_bytes, err := parseHCLFile(file_path)
+	if err != nil {
+		return nil, err
+	}
+	content, diagnostics := body.Content(&hcl.BodySchema{Blocks: []hcl.BlockHeaderSchema{
+		{Type: "app"}, {Type: "pack"}, {Type: "integration"}, {Type: "dependency", LabelNames: []string{"name"}},
+	}})
+	if diagnostics.HasErrors() {
+		return nil, diagnostics
+	}
+
+	metadata = map[string]string{}
+	for _, block := range content.Blocks {
+		if block.Type == "dependency" {
+			return nil, fmt.Errorf("pack dependencies are not supported, found dependency %q", block.Labels[0])
+		}
+		attributes, diagnostics := block.Body.JustAttributes()
+		if diagnostics.HasErrors() {
+			return nil, diagnostics
+		}
+		for name, attribute := range attributes {
+			value, diagnostics := attribute.Expr.Value(nil)
+			if diagnostics.HasErrors() {
+				return nil, diagnostics
+			}
+			if value.Type() == cty.String && !value.IsNull() {
+				metadata[block.Type+"."+name] = value.AsString()
+			} else {
+				metadata[block.Type+"."+name] = string(attribute.Expr.Range().SliceBytes(file_contents_bytes))
+			}
+		}
+	}
+	return
+}
+
+// readPackVariables returns the variables declared by a pack with their default values, nil if they have none
+func readPackVariables(file_path string) (variables map[string]interface{}, err error) {
+	variables = map[string]interface{}{}
+	body, _, err := parseHCLFile(file_path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return variables, nil // a pack without variables
+	}
+	if err != nil {
+		return nil, err
+	}
+	content, _, diagnostics := body.PartialContent(&hcl.BodySchema{
+		Blocks: []hcl.BlockHeaderSchema{{Type: "variable", LabelNames: []string{"name"}}},
+	})
+	if diagnostics.HasErrors() {
+		return nil, diagnostics
+	}
+	for _, block := range content.Blocks {
+		variable_content, _, diagnostics := block.Body.PartialContent(&hcl.BodySchema{
+			Attributes: []hcl.AttributeSchema{{Name: "default"}},
+		})
+		if diagnostics.HasErrors() {
+			return nil, diagnostics
+		}
+		variables[block.Labels[0]] = nil
+		if attribute, has_default := variable_content.Attributes["default"]; has_default {
+			variables[block.Labels[0]], err = evaluateHCLExpression(attribute.Expr)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return
+}
+
+// readHCLAttributeValues reads a file of `name = value` attributes, such as a pack values file
+func readHCLAttributeValues(file_path string) (values map[string]interface{}, err error) {
+	body, _, err := parseHCLFile(file_path)
+	if err != nil {
+		return nil, err
+	}
+	attributes, diagnostics := body.JustAttributes()
+	if diagnostics.HasErrors() {
+		return nil, diagnostics
+	}
+	values = map[string]interface{}{}
+	for name, attribute := range attributes {
+		values[name], err = evaluateHCLExpression(attribute.Expr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+func parseHCLFile(file_path string) (body hcl.Body, file_contents_bytes []byte, err error) {
+	file_contents_bytes, err = os.ReadFile(file_path)
+	if err != nil {
+		return nil, nil, err
+	}
+	file_hcl, diagnostics := hclparse.NewParser().ParseHCL(file_contents_bytes, file_path)
+	if diagnostics.HasErrors() {
+		return nil, nil, diagnostics
+	}
+	return file_hcl.Body, file_contents_bytes, nil
+}
+
+// evaluateHCLExpression evaluates a constant HCL expression to plain Go values, as decoded from JSON
+func evaluateHCLExpression(expression hcl.Expression) (value interface{}, err error) {
+	cty_value, diagnostics := expression.Value(nil)
+	if diagnostics.HasErrors() {
+		return nil, diagnostics
+	}
+	if cty_value.IsNull() {
+		return nil, nil
+	}
+	json_bytes, err := ctyjson.Marshal(cty_value, cty_value.Type())
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(json_bytes))
+	decoder.UseNumber() // so that whole numbers are rendered without decimals
+	err = decoder.Decode(&value)
+	return
+}
+
+// packTemplateFunctions are the functions available to pack templates, a subset of those provided by nomad-pack
+func packTemplateFunctions(variables map[string]interface{}, metadata map[string]string) template.FuncMap {
+	to_json := func(value interface{}) string {
+		json_bytes, _ := json.Marshal(value)
+		return string(json_bytes)
+	}
+	indent := func(spaces int, text string) string {
+		padding := strings.Repeat(" ", spaces)
+		return padding + strings.ReplaceAll(text, "\n", "\n"+padding)
+	}
+	empty := func(value interface{}) bool {
+		switch typed := value.(type) {
+		case nil:
+			return true
+		case string:
+			return typed == ""
+		case bool:
+			return !typed
+		case json.Number:
+			return typed.String() == "0"
+		case []interface{}:
+			return len(typed) == 0
+		case map[string]interface{}:
+			return len(typed) == 0
+		}
+		return false
+	}
+
+	return template.FuncMap{
+		"var":  func(name string, _ interface{}) interface{} { return variables[name] },
+		"meta": func(name string, _ interface{}) string { return metadata[name] },
+
+		"quote":  func(value interface{}) string { return fmt.Sprintf("%q", fmt.Sprint(value)) },
+		"squote": func(value interface{}) string { return "'" + fmt.Sprint(value) + "'" },
+		"toJson": to_json,
+		"toPrettyJson": func(value interface{}) string {
+			json_bytes, _ := json.MarshalIndent(value, "", "  ")
+			return string(json_bytes)
+		},
+		"empty": empty,
+		"default": func(fallback interface{}, value interface{}) interface{} {
+			if empty(value) {
+				return fallback
+			}
+			return value
+		},
+		"coalesce": func(values ...interface{}) interface{} {
+			for _, value := range values {
+				if !empty(value) {
+					return value
+				}
+			}
+			return nil
+		},
+		"ternary": func(if_true interface{}, if_false interface{}, condition bool) interface{} {
+			if condition {
+				return if_true
+			}
+			return if_false
+		},
+		"join": func(separator string, values []interface{}) string {
+			strings_to_join := []string{}
+			for _, value := range values {
+				strings_to_join = append(strings_to_join, fmt.Sprint(value))
+			}
+			return strings.Join(strings_to_join, separator)
+		},
+		"contains":  func(substring string, text string) bool { return strings.Contains(text, substring) },
+		"hasPrefix": func(prefix string, text string) bool { return strings.HasPrefix(text, prefix) },
+		"hasSuffix": func(suffix string, text string) bool { return strings.HasSuffix(text, suffix) },
+		"replace":   func(old string, new string, text string) string { return strings.ReplaceAll(text, old, new) },
+		"upper":     strings.ToUpper,
+		"lower":     strings.ToLower,
+		"trim":      strings.TrimSpace,
+		"indent":    indent,
+		"nindent":   func(spaces int, text string) string { return "\n" + indent(spaces, text) },
+	}
+}
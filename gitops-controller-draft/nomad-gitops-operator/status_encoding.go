@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Nomad Variables are limited to 64KiB each, so large `status` documents are stored in up to three ways:
+//   - plain JSON, as long as it fits in MAX_STATUS_ITEM_SIZE
+//   - gzip compressed and base64 encoded, prefixed with STATUS_GZIP_PREFIX
+//   - compressed and split across child objects at `<path>/_status/<index>`, with the status item only holding
+//     STATUS_SHARDED_PREFIX, the number of shards and a checksum of their contents
+//
+// If even MAX_STATUS_SHARDS are not enough, the oldest entries of the status are dropped until it fits.
+const (
+	STATUS_SHARD_PATH_SEGMENT = "/_status/"
+	STATUS_GZIP_PREFIX        = "gzip+base64:"
+	STATUS_SHARDED_PREFIX     = "sharded:"
+	MAX_STATUS_ITEM_SIZE      = 32 * 1024 // leaves room for the spec and other items of the object itself
+	STATUS_SHARD_SIZE         = 60 * 1024
+	MAX_STATUS_SHARDS         = 16
+)
+
+// TruncatableStatus is implemented by statuses that can drop their oldest entries to fit within the size limits
+type TruncatableStatus interface {
+	// TruncateOldest drops some of the oldest entries, returning false if there is nothing left to drop
+	TruncateOldest() bool
+}
+
+func IsStatusShardPath(path string) bool {
+	return strings.Contains(path, STATUS_SHARD_PATH_SEGMENT)
+}
+
+func getStatusShardPath(object_path string, index int) string {
+	return object_path + STATUS_SHARD_PATH_SEGMENT + strconv.Itoa(index)
+}
+
+// encodeStatusDocument returns the status item to store on the object, and the contents of its shards if any
+func encodeStatusDocument(document string) (status_item string, shards []string) {
+	if len(document) <= MAX_STATUS_ITEM_SIZE {
+		return document, nil
+	}
+
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write([]byte(document))
+	writer.Close()
+	encoded := base64.StdEncoding.EncodeToString(compressed.Bytes())
+	if len(STATUS_GZIP_PREFIX)+len(encoded) <= MAX_STATUS_ITEM_SIZE {
+		return STATUS_GZIP_PREFIX + encoded, nil
+	}
+
+	for start := 0; start < len(encoded); start += STATUS_SHARD_SIZE {
+		shards = append(shards, encoded[start:min(start+STATUS_SHARD_SIZE, len(encoded))])
+	}
+	checksum := sha256.Sum256([]byte(encoded))
+	status_item = fmt.Sprintf("%s%d:%s", STATUS_SHARDED_PREFIX, len(shards), hex.EncodeToString(checksum[:]))
+	return
+}
+
+// decodeStatusItem turns a stored status item back into a JSON document, using the shards resolved for the object
+func decodeStatusItem(status_item string, shards []string) (string, error) {
+	var encoded string
+	switch {
+	case strings.HasPrefix(status_item, STATUS_GZIP_PREFIX):
+		encoded = strings.TrimPrefix(status_item, STATUS_GZIP_PREFIX)
+	case strings.HasPrefix(status_item, STATUS_SHARDED_PREFIX):
+		shard_count, checksum, _ := strings.Cut(strings.TrimPrefix(status_item, STATUS_SHARDED_PREFIX), ":")
+		if strconv.Itoa(len(shards)) != shard_count {
+			return "", fmt.Errorf("expected %s status shards, found %d", shard_count, len(shards))
+		}
+		encoded = strings.Join(shards, "")
+		actual_checksum := sha256.Sum256([]byte(encoded))
+		if hex.EncodeToString(actual_checksum[:]) != checksum {
+			return "", fmt.Errorf("status shards do not match their checksum, they may be mid-update")
+		}
+	default:
+		return status_item, nil
+	}
+
+	compressed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return "", err
+	}
+	document, err := io.ReadAll(reader)
+	return string(document), err
+}
+
+// resolveStatusShards removes status shards from a list of objects, attaching them to the objects they belong to
+func resolveStatusShards(objects []StoredObject) (resolved []StoredObject) {
+	shards_by_path := map[string]string{}
+	for _, object := range objects {
+		if IsStatusShardPath(object.Path) {
+			shards_by_path[object.Path] = object.Items["data"]
+		}
+	}
+	for _, object := range objects {
+		if IsStatusShardPath(object.Path) {
+			continue
+		}
+		if strings.HasPrefix(object.Items["status"], STATUS_SHARDED_PREFIX) {
+			for index := 0; ; index++ {
+				shard, exists := shards_by_path[getStatusShardPath(object.Path, index)]
+				if !exists {
+					break
+				}
+				object.StatusShards = append(object.StatusShards, shard)
+			}
+		}
+		resolved = append(resolved, object)
+	}
+	return
+}
+
+// writeStatusItem sets the status item of an object, writing shards to the store first if the status needs them.
+// The object itself is not written.
+func writeStatusItem(store ObjectStore, object *StoredObject, status interface{}) error {
+	status_item, shards := encodeStatusDocument(mustMarshalJSON(status))
+	for len(shards) > MAX_STATUS_SHARDS {
+		truncatable_status, ok := status.(TruncatableStatus)
+		if !ok || !truncatable_status.TruncateOldest() {
+			return fmt.Errorf("status of %s is too large to store, even when sharded", object.Path)
+		}
+		status_item, shards = encodeStatusDocument(mustMarshalJSON(status))
+	}
+
+	for index, shard := range shards {
+		shard_path := getStatusShardPath(object.Path, index)
+		existing, err := store.Get(shard_path)
+		if err != nil {
+			return err
+		}
+		shard_object := &StoredObject{Namespace: object.Namespace, Path: shard_path, Items: map[string]string{"data": shard}}
+		if existing != nil {
+			shard_object.ModifyIndex = existing.ModifyIndex
+		}
+		err = store.Put(shard_object)
+		if err != nil {
+			return err
+		}
+	}
+	object.Items["status"] = status_item
+	return deleteStatusShards(store, object.Path, len(shards))
+}
+
+// deleteStatusShards removes the shards of an object starting from the given index
+func deleteStatusShards(store ObjectStore, object_path string, from_index int) error {
+	existing_shards, err := store.List(object_path + STATUS_SHARD_PATH_SEGMENT)
+	if err != nil {
+		return err
+	}
+	for _, shard := range existing_shards {
+		index, err := strconv.Atoi(strings.TrimPrefix(shard.Path, object_path+STATUS_SHARD_PATH_SEGMENT))
+		if err != nil || index < from_index {
+			continue
+		}
+		err = store.Delete(shard.Path, shard.ModifyIndex)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+var test_random = rand.New(rand.NewSource(1))
+
+// incompressibleString returns random hex, which compresses to about half its size
+func incompressibleString(size int) string {
+	data := make([]byte, size/2)
+	test_random.Read(data)
+	return hex.EncodeToString(data)
+}
+
+func TestStatusDocumentRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		document string
+		prefix   string
+		shards   int
+	}{
+		{"plain", `{"current_commit":"abc"}`, "{", 0},
+		{"compressed", `{"message":"` + strings.Repeat("a", 2*MAX_STATUS_ITEM_SIZE) + `"}`, STATUS_GZIP_PREFIX, 0},
+		{"sharded", `{"message":"` + incompressibleString(200*1024) + `"}`, STATUS_SHARDED_PREFIX, 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status_item, shards := encodeStatusDocument(test.document)
+			if !strings.HasPrefix(status_item, test.prefix) || len(shards) != test.shards {
+				t.Fatalf("got status item %.40q with %d shards, want prefix %q with %d shards", status_item, len(shards), test.prefix, test.shards)
+			}
+			if len(status_item) > MAX_STATUS_ITEM_SIZE {
+				t.Fatalf("status item of %d bytes exceeds %d", len(status_item), MAX_STATUS_ITEM_SIZE)
+			}
+			document, err := decodeStatusItem(status_item, shards)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if document != test.document {
+				t.Fatal("decoded document differs from the encoded one")
+			}
+		})
+	}
+}
+
+func TestDecodeStatusItemErrors(t *testing.T) {
+	status_item, shards := encodeStatusDocument(`{"message":"` + incompressibleString(200*1024) + `"}`)
+	tests := []struct {
+		name        string
+		status_item string
+		shards      []string
+	}{
+		{"missing shard", status_item, shards[:len(shards)-1]},
+		{"shard mid-update", status_item, append([]string{shards[1]}, shards[1:]...)},
+		{"invalid base64", STATUS_GZIP_PREFIX + "%%%", nil},
+		{"not gzip", STATUS_GZIP_PREFIX + "bm90IGd6aXA=", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := decodeStatusItem(test.status_item, test.shards); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestResolveStatusShards(t *testing.T) {
+	path := NOMAD_VAR_GITREPOSITORY_PREFIXES[0] + "app"
+	objects := []StoredObject{
+		{Path: getStatusShardPath(path, 1), Items: map[string]string{"data": "b"}},
+		{Path: path, Items: map[string]string{"status": STATUS_SHARDED_PREFIX + "2:checksum"}},
+		{Path: getStatusShardPath(path, 0), Items: map[string]string{"data": "a"}},
+		{Path: path + "-plain", Items: map[string]string{"status": "{}"}},
+	}
+	resolved := resolveStatusShards(objects)
+	if len(resolved) != 2 {
+		t.Fatalf("got %d objects, want the 2 that are not shards", len(resolved))
+	}
+	if strings.Join(resolved[0].StatusShards, ",") != "a,b" || resolved[1].StatusShards != nil {
+		t.Fatalf("got shards %v and %v", resolved[0].StatusShards, resolved[1].StatusShards)
+	}
+}
+
+func TestWriteStatusItem(t *testing.T) {
+	tests := []struct {
+		name      string
+		events    int
+		sharded   bool
+		truncated bool
+	}{
+		{"plain", 1, false, false},
+		{"sharded", 40, true, false},
+		{"truncated", 400, true, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := NewFileStore(t.TempDir())
+			object := &StoredObject{Path: NOMAD_VAR_GITREPOSITORY_PREFIXES[0] + "app", Items: map[string]string{}}
+			status := &GitRepositoryStatus{CurrentCommit: "abc"}
+			for index := 0; index < test.events; index++ {
+				status.Events = append(status.Events, StatusEvent{Reason: "Synced", Message: incompressibleString(4 * 1024)})
+			}
+
+			err := writeStatusItem(store, object, status)
+			if err != nil {
+				t.Fatal(err)
+			}
+			shards, err := store.List(object.Path + STATUS_SHARD_PATH_SEGMENT)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (len(shards) > 0) != test.sharded || len(shards) > MAX_STATUS_SHARDS {
+				t.Fatalf("got %d shards, want sharded %v within %d shards", len(shards), test.sharded, MAX_STATUS_SHARDS)
+			}
+			if (status.TruncatedEvents > 0) != test.truncated {
+				t.Fatalf("got %d truncated events", status.TruncatedEvents)
+			}
+
+			object.StatusShards = resolveStatusShards(append([]StoredObject{*object}, shards...))[0].StatusShards
+			document, err := decodeStatusItem(object.Items["status"], object.StatusShards)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded := GitRepositoryStatus{}
+			if err := json.Unmarshal([]byte(document), &decoded); err != nil {
+				t.Fatal(err)
+			}
+			if decoded.CurrentCommit != "abc" || len(decoded.Events) != len(status.Events) {
+				t.Fatalf("got commit %q with %d events, want %d", decoded.CurrentCommit, len(decoded.Events), len(status.Events))
+			}
+
+			// Rewriting a smaller status removes the shards no longer needed
+			status.Events = nil
+			if err := writeStatusItem(store, object, status); err != nil {
+				t.Fatal(err)
+			}
+			shards, _ = store.List(object.Path + STATUS_SHARD_PATH_SEGMENT)
+			if len(shards) != 0 {
+				t.Fatalf("got %d shards left over", len(shards))
+			}
+		})
+	}
+}
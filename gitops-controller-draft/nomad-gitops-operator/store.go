@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/nomad/api"
+	"go.uber.org/zap"
+)
+
+// ErrObjectConflict is returned by ObjectStore writes when the stored object was modified since it was read
+var ErrObjectConflict = errors.New("object was modified concurrently")
+
+// StoredObject is the backend-agnostic form of an object: its location, its items and an index used for CAS
+type StoredObject struct {
+	Namespace   string            `json:"namespace"`
+	Path        string            `json:"path"`
+	Items       map[string]string `json:"items"`
+	ModifyIndex uint64            `json:"-"`
+
+	// StatusShards holds the contents of the status shards of the object, if its status is sharded
+	StatusShards []string `json:"-"`
+}
+
+// ObjectStore is where GitRepository and NomadJobGroup objects are read from and written to
+type ObjectStore interface {
+	// List returns every object with a path under the given prefix
+	List(prefix string) ([]StoredObject, error)
+
+	// Get returns the object at the given path, or nil if there is none
+	Get(path string) (*StoredObject, error)
+
+	// Put writes an object only if the stored object still has the given ModifyIndex, 0 meaning it must not exist yet.
+	// Returns ErrObjectConflict otherwise.
+	Put(object *StoredObject) error
+
+	// Delete removes an object only if the stored object still has the given modify index
+	Delete(path string, modify_index uint64) error
+
+	// WaitForChange blocks until anything under the prefix changes past last_index, or until the timeout elapses.
+	// Returns the new index to wait on.
+	WaitForChange(prefix string, last_index uint64, timeout time.Duration) (uint64, error)
+}
+
+func InitializeObjectStore(client *api.Client) ObjectStore {
+	switch OBJECT_STORE_BACKEND {
+	case "nomad-variables":
+		return NewNomadVariableStore(client, controller_namespace)
+	case "consul-kv":
+		return NewConsulKVStore(InitializeConsulApiClient(), controller_namespace)
+	case "file":
+		return NewFileStore(OBJECT_STORE_PATH)
+	}
+	logger.Fatal("unknown object store backend, expected one of `nomad-variables`, `consul-kv`, `file`",
+		zap.String("objectStore", OBJECT_STORE_BACKEND),
+	)
+	return nil
+}
+
+// WatchObjectStore uses blocking queries to trigger a reconciliation as soon as any object's spec changes.
+// Changes to the items the controllers write themselves on every run, such as `status`, are ignored.
+func WatchObjectStore(store ObjectStore, reconcile func()) {
+	last_index := uint64(0)
+	last_fingerprint := ""
+	for {
+		index, err := store.WaitForChange(NOMAD_VAR_PREFIX, last_index, 5*time.Minute)
+		if err != nil {
+			logger.Error("failed to wait for changes in the object store",
+				zap.Error(err),
+			)
+			time.Sleep(10 * time.Second)
+			continue
+		}
+		if index < last_index {
+			index = 0 // the index went backwards, e.g. after a store restore, so start over
+		}
+		if index == last_index {
+			continue // timed out without changes
+		}
+		last_index = index
+
+		fingerprint := objectStoreFingerprint(store)
+		if last_fingerprint != "" && fingerprint != last_fingerprint {
+			logger.Info("object store changed, triggering reconciliation")
+			reconcile()
+		}
+		last_fingerprint = fingerprint
+	}
+}
+
+// objectStoreFingerprint hashes every stored object except for the items written by the controller
+func objectStoreFingerprint(store ObjectStore) string {
+	objects, err := store.List(NOMAD_VAR_PREFIX)
+	if err != nil {
+		return ""
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Path < objects[j].Path })
+
+	hash := sha256.New()
+	for _, object := range objects {
+		if IsStatusShardPath(object.Path) {
+			continue
+		}
+		keys := []string{}
+		for key := range object.Items {
+			if !slices.Contains(CONTROLLER_OWNED_ITEMS, key) {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		hash.Write([]byte(object.Path))
+		for _, key := range keys {
+			hash.Write([]byte(key + "=" + object.Items[key]))
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"go.uber.org/zap"
+)
+
+// ConsulKVStore keeps objects in Consul's key/value store, one key per object path.
+// The value is the JSON encoding of a StoredObject, e.g. `{"namespace": "default", "items": {...}}`. Keys are not
+// namespaced, so the store only holds objects of the controller's namespace and rejects others.
+type ConsulKVStore struct {
+	client    *consulapi.Client
+	namespace string
+}
+
+func NewConsulKVStore(client *consulapi.Client, namespace string) *ConsulKVStore {
+	return &ConsulKVStore{client: client, namespace: namespace}
+}
+
+// InitializeConsulApiClient uses the same env vars as the Consul CLI, e.g. `CONSUL_HTTP_ADDR`
+func InitializeConsulApiClient() (client *consulapi.Client) {
+	client, err := consulapi.NewClient(consulapi.DefaultConfig())
+	if err != nil {
+		logger.Error("failed to initialize Consul client",
+			zap.Error(err),
+		)
+		panic(err)
+	}
+	return
+}
+
+func (store *ConsulKVStore) decodePair(pair *consulapi.KVPair) (*StoredObject, error) {
+	object := StoredObject{}
+	err := json.Unmarshal(pair.Value, &object)
+	if err != nil {
+		return nil, err
+	}
+	object.Path = pair.Key
+	object.ModifyIndex = pair.ModifyIndex
+	if object.Namespace == "" {
+		object.Namespace = store.namespace
+	}
+	return &object, store.checkNamespace(&object)
+}
+
+func (store *ConsulKVStore) checkNamespace(object *StoredObject) error {
+	if object.Namespace != "" && object.Namespace != store.namespace {
+		return fmt.Errorf("object %s is in namespace %s, but the Consul KV store only holds objects of namespace %s",
+			object.Path, object.Namespace, store.namespace)
+	}
+	return nil
+}
+
+func (store *ConsulKVStore) List(prefix string) (objects []StoredObject, err error) {
+	pairs, _, err := store.client.KV().List(prefix, &consulapi.QueryOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, pair := range pairs {
+		object, err := store.decodePair(pair)
+		if err != nil {
+			logger.Error("failed to decode Consul KV value as an object, skipping it",
+				zap.String("key", pair.Key),
+				zap.Error(err),
+			)
+			continue
+		}
+		objects = append(objects, *object)
+	}
+	return
+}
+
+func (store *ConsulKVStore) Get(path string) (*StoredObject, error) {
+	pair, _, err := store.client.KV().Get(path, &consulapi.QueryOptions{})
+	if err != nil || pair == nil {
+		return nil, err
+	}
+	return store.decodePair(pair)
+}
+
+func (store *ConsulKVStore) Put(object *StoredObject) error {
+	err := store.checkNamespace(object)
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(object)
+	if err != nil {
+		return err
+	}
+
+	// Consul does not return the new index from a CAS write, so it is read back in the same transaction, before any
+	// other writer could change the key
+	written, response, _, err := store.client.KV().Txn(consulapi.KVTxnOps{
+		{Verb: consulapi.KVCAS, Key: object.Path, Value: value, Index: object.ModifyIndex}, // 0 only allows creating the key
+		{Verb: consulapi.KVGet, Key: object.Path},
+	}, &consulapi.QueryOptions{})
+	if err != nil {
+		return err
+	}
+	if !written {
+		return ErrObjectConflict
+	}
+	for _, pair := range response.Results {
+		if pair.Key == object.Path {
+			object.ModifyIndex = pair.ModifyIndex
+		}
+	}
+	return nil
+}
+
+func (store *ConsulKVStore) Delete(path string, modify_index uint64) error {
+	deleted, _, err := store.client.KV().DeleteCAS(&consulapi.KVPair{
+		Key:         path,
+		ModifyIndex: modify_index,
+	}, &consulapi.WriteOptions{})
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return ErrObjectConflict
+	}
+	return nil
+}
+
+func (store *ConsulKVStore) WaitForChange(prefix string, last_index uint64, timeout time.Duration) (uint64, error) {
+	_, query_meta, err := store.client.KV().Keys(prefix, "", &consulapi.QueryOptions{
+		WaitIndex: last_index,
+		WaitTime:  timeout,
+	})
+	if err != nil {
+		return last_index, err
+	}
+	return query_meta.LastIndex, nil
+}
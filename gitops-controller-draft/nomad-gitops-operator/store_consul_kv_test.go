@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// testConsulKV fakes the KV endpoints of Consul used by ConsulKVStore
+type testConsulKV struct {
+	lock  sync.Mutex
+	index uint64
+	pairs map[string]*consulapi.KVPair
+
+	after_txn func() // runs after each transaction, e.g. to write concurrently
+}
+
+func (kv *testConsulKV) set(key string, value []byte) {
+	kv.index++
+	kv.pairs[key] = &consulapi.KVPair{Key: key, Value: value, ModifyIndex: kv.index}
+}
+
+func (kv *testConsulKV) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	kv.lock.Lock()
+	defer func() {
+		kv.lock.Unlock()
+		if request.URL.Path == "/v1/txn" && kv.after_txn != nil {
+			kv.after_txn()
+		}
+	}()
+
+	switch {
+	case request.URL.Path == "/v1/txn":
+		ops := consulapi.TxnOps{}
+		if err := json.NewDecoder(request.Body).Decode(&ops); err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+		response := consulapi.TxnResponse{}
+		for index, op := range ops {
+			switch existing := kv.pairs[op.KV.Key]; op.KV.Verb {
+			case consulapi.KVCAS:
+				if (existing == nil && op.KV.Index != 0) || (existing != nil && existing.ModifyIndex != op.KV.Index) {
+					response.Errors = append(response.Errors, &consulapi.TxnError{OpIndex: index, What: "index mismatch"})
+					writer.WriteHeader(http.StatusConflict)
+					json.NewEncoder(writer).Encode(response)
+					return
+				}
+				kv.set(op.KV.Key, op.KV.Value)
+				response.Results = append(response.Results, &consulapi.TxnResult{KV: &consulapi.KVPair{Key: op.KV.Key, ModifyIndex: kv.index}})
+			case consulapi.KVGet:
+				response.Results = append(response.Results, &consulapi.TxnResult{KV: existing})
+			}
+		}
+		json.NewEncoder(writer).Encode(response)
+	case request.Method == http.MethodGet && strings.HasPrefix(request.URL.Path, "/v1/kv/"):
+		pair, exists := kv.pairs[strings.TrimPrefix(request.URL.Path, "/v1/kv/")]
+		if !exists {
+			http.NotFound(writer, request)
+			return
+		}
+		json.NewEncoder(writer).Encode([]*consulapi.KVPair{pair})
+	default:
+		http.Error(writer, "not implemented by the fake", http.StatusNotImplemented)
+	}
+}
+
+func testConsulKVStore(t *testing.T) (*ConsulKVStore, *testConsulKV) {
+	kv := &testConsulKV{pairs: map[string]*consulapi.KVPair{}}
+	server := httptest.NewServer(kv)
+	t.Cleanup(server.Close)
+	client, err := consulapi.NewClient(&consulapi.Config{Address: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewConsulKVStore(client, "default"), kv
+}
+
+func TestConsulKVStorePut(t *testing.T) {
+	store, kv := testConsulKVStore(t)
+	object := &StoredObject{Path: "nomadops/v2/gitrepository/app", Items: map[string]string{"spec": "{}"}}
+	if err := store.Put(object); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(&StoredObject{Path: object.Path}); !errors.Is(err, ErrObjectConflict) {
+		t.Fatalf("got %v, want a conflict when creating an existing object", err)
+	}
+
+	// A writer changing the object right after the write doesn't pass its index on to the store
+	kv.after_txn = func() {
+		kv.lock.Lock()
+		defer kv.lock.Unlock()
+		kv.set(object.Path, []byte(`{"items":{"spec":"{\"other\":true}"}}`))
+	}
+	object.Items["status"] = "{}"
+	if err := store.Put(object); err != nil {
+		t.Fatal(err)
+	}
+	kv.after_txn = nil
+	if err := store.Put(object); !errors.Is(err, ErrObjectConflict) {
+		t.Fatalf("got %v, want a conflict instead of overwriting the other writer", err)
+	}
+	current, err := store.Get(object.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Items["spec"] != `{"other":true}` {
+		t.Fatalf("got spec %s, want the other writer's", current.Items["spec"])
+	}
+
+	if err := store.Put(&StoredObject{Namespace: "prod", Path: "nomadops/v2/gitrepository/prod"}); err == nil {
+		t.Fatal("expected an error for an object in another namespace")
+	}
+}
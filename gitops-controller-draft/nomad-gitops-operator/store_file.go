@@ -0,0 +1,315 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclparse"
+	"go.uber.org/zap"
+)
+
+const FILE_STORE_SIDECAR_SUFFIX = ".status.json"
+
+// FILE_STORE_SIDECAR_ITEMS are the items stored in the sidecar of an object with a definition file
+var FILE_STORE_SIDECAR_ITEMS = append([]string{"owner_path", "owner_source_file"}, CONTROLLER_OWNED_ITEMS...)
+
+// FileStore reads objects from a directory of HCL files in the same format as `manifests/`, i.e. the `nomad var put` format.
+// The items the controller owns, such as `status`, go to a sidecar file next to the definition (`<file>.status.json`), so
+// the definitions themselves are never modified. Objects created by the controller that have no definition file only
+// exist as a sidecar, named after their path. Reading never deletes anything: sidecars left over from definitions that
+// were deleted, or that currently fail to parse, are ignored and reported, so the status is kept until removed by hand.
+type FileStore struct {
+	directory string
+	lock      sync.Mutex
+
+	// WaitForChange polls the directory, bumping the index whenever its contents change
+	watch_index uint64
+	watch_state string
+
+	// Definitions failing to parse and sidecars without a definition that were already reported, so that each is only
+	// logged once rather than on every read
+	reported_files map[string]bool
+}
+
+type fileStoreSidecar struct {
+	StoredObject
+	ModifyIndex uint64 `json:"modify_index"`
+}
+
+type fileStoreEntry struct {
+	object          StoredObject
+	definition_file string // empty for objects that only exist as a sidecar
+	sidecar_file    string
+}
+
+func NewFileStore(directory string) *FileStore {
+	return &FileStore{directory: directory}
+}
+
+// readEntries loads all objects in the directory, with sidecar items merged over those from definition files
+func (store *FileStore) readEntries() (entries map[string]*fileStoreEntry, err error) {
+	entries = map[string]*fileStoreEntry{}
+	sidecar_files := []string{}
+	reported_files := map[string]bool{}
+	defer func() { store.reported_files = reported_files }()
+
+	err = filepath.WalkDir(store.directory, func(file_path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		if strings.HasSuffix(file_path, FILE_STORE_SIDECAR_SUFFIX) {
+			sidecar_files = append(sidecar_files, file_path)
+			return nil
+		}
+		if filepath.Ext(file_path) != ".hcl" {
+			return nil
+		}
+
+		file_contents_bytes, err := os.ReadFile(file_path)
+		if err != nil {
+			return err
+		}
+		object_file, err := ParseObjectFile(file_contents_bytes, file_path)
+		if err != nil {
+			// The directory may contain other HCL files, e.g. job specifications, but a definition being edited may
+			// also fail to parse for a while, in which case its sidecar is ignored until it parses again
+			if !isMeantAsObjectDefinition(file_path, file_contents_bytes) {
+				logger.Debug("skipping file that is not an object definition",
+					zap.String("fileName", file_path),
+					zap.Error(err),
+				)
+				return nil
+			}
+			if !store.reported_files[file_path] {
+				logger.Warn("failed to parse object definition, ignoring it",
+					zap.String("fileName", file_path),
+					zap.Error(err),
+				)
+			}
+			reported_files[file_path] = true
+			return nil
+		}
+		if existing, exists := entries[object_file.Path]; exists {
+			return fmt.Errorf("object %s is defined in both %s and %s", object_file.Path, existing.definition_file, file_path)
+		}
+		entries[object_file.Path] = &fileStoreEntry{
+			object:          *object_file.ConvertToStoredObject(),
+			definition_file: file_path,
+			sidecar_file:    file_path + FILE_STORE_SIDECAR_SUFFIX,
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, sidecar_file := range sidecar_files {
+		file_contents_bytes, err := os.ReadFile(sidecar_file)
+		if err != nil {
+			return nil, err
+		}
+		sidecar := fileStoreSidecar{}
+		err = json.Unmarshal(file_contents_bytes, &sidecar)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode sidecar file %s: %w", sidecar_file, err)
+		}
+
+		entry, exists := entries[sidecar.Path]
+		switch {
+		case exists && entry.sidecar_file == sidecar_file:
+			// Only the controller-owned items are taken from the sidecar, so that editing the definition takes effect
+			for _, key := range FILE_STORE_SIDECAR_ITEMS {
+				if value, is_set := sidecar.Items[key]; is_set {
+					entry.object.Items[key] = value
+				}
+			}
+		case !exists && sidecar_file == store.getSidecarOnlyFile(sidecar.Path):
+			entry = &fileStoreEntry{object: StoredObject{Namespace: sidecar.Namespace, Path: sidecar.Path, Items: sidecar.Items}}
+			entries[sidecar.Path] = entry
+		default:
+			// Left over from a definition file that was deleted, no longer defines the object, or fails to parse
+			if !store.reported_files[sidecar_file] {
+				logger.Warn("ignoring sidecar file of an object that is not defined, remove it if the object was deleted",
+					zap.String("fileName", sidecar_file),
+					zap.String("variablePath", sidecar.Path),
+				)
+			}
+			reported_files[sidecar_file] = true
+			continue
+		}
+		entry.sidecar_file = sidecar_file
+		entry.object.ModifyIndex = sidecar.ModifyIndex
+	}
+
+	// Objects only defined in a file have not been written by the controller yet
+	for _, entry := range entries {
+		if entry.object.ModifyIndex == 0 {
+			entry.object.ModifyIndex = 1
+		}
+	}
+	return
+}
+
+func (store *FileStore) List(prefix string) (objects []StoredObject, err error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	entries, err := store.readEntries()
+	if err != nil {
+		return nil, err
+	}
+	for path, entry := range entries {
+		if strings.HasPrefix(path, prefix) {
+			objects = append(objects, entry.object)
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Path < objects[j].Path })
+	return
+}
+
+func (store *FileStore) Get(path string) (*StoredObject, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	entries, err := store.readEntries()
+	if err != nil {
+		return nil, err
+	}
+	entry, exists := entries[path]
+	if !exists {
+		return nil, nil
+	}
+	return &entry.object, nil
+}
+
+func (store *FileStore) Put(object *StoredObject) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	entries, err := store.readEntries()
+	if err != nil {
+		return err
+	}
+	entry, exists := entries[object.Path]
+	if (exists && entry.object.ModifyIndex != object.ModifyIndex) || (!exists && object.ModifyIndex != 0) {
+		return ErrObjectConflict
+	}
+	sidecar := fileStoreSidecar{StoredObject: *object, ModifyIndex: object.ModifyIndex + 1}
+	sidecar_file := store.getSidecarOnlyFile(object.Path)
+	if exists && entry.definition_file != "" {
+		sidecar_file = entry.sidecar_file
+		sidecar.Items = map[string]string{}
+		for _, key := range FILE_STORE_SIDECAR_ITEMS {
+			if value, is_set := object.Items[key]; is_set {
+				sidecar.Items[key] = value
+			}
+		}
+	}
+
+	sidecar_bytes, err := json.MarshalIndent(sidecar, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(sidecar_file, sidecar_bytes, 0o644)
+	if err != nil {
+		return err
+	}
+	object.ModifyIndex = sidecar.ModifyIndex
+	return nil
+}
+
+// isMeantAsObjectDefinition tells whether a file that failed to parse as an object definition was meant as one, i.e. it
+// is not valid HCL, sets a `path`, or already has a sidecar
+func isMeantAsObjectDefinition(file_path string, file_contents_bytes []byte) bool {
+	if _, err := os.Stat(file_path + FILE_STORE_SIDECAR_SUFFIX); err == nil {
+		return true
+	}
+	file_hcl, diagnostics := hclparse.NewParser().ParseHCL(file_contents_bytes, file_path)
+	if diagnostics.HasErrors() {
+		return true
+	}
+	content, _, _ := file_hcl.Body.PartialContent(&hcl.BodySchema{Attributes: []hcl.AttributeSchema{{Name: "path"}}})
+	_, has_path := content.Attributes["path"]
+	return has_path
+}
+
+// getSidecarOnlyFile returns where an object without a definition file is stored
+func (store *FileStore) getSidecarOnlyFile(path string) string {
+	return filepath.Join(store.directory, url.PathEscape(path)+FILE_STORE_SIDECAR_SUFFIX)
+}
+
+func (store *FileStore) Delete(path string, modify_index uint64) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	entries, err := store.readEntries()
+	if err != nil {
+		return err
+	}
+	entry, exists := entries[path]
+	if !exists {
+		return nil
+	}
+	if entry.object.ModifyIndex != modify_index {
+		return ErrObjectConflict
+	}
+	if entry.definition_file != "" {
+		return fmt.Errorf("object %s is defined in %s, remove the file to delete it", path, entry.definition_file)
+	}
+	return os.Remove(entry.sidecar_file)
+}
+
+func (store *FileStore) WaitForChange(prefix string, last_index uint64, timeout time.Duration) (uint64, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		state, err := store.directoryState()
+		if err != nil {
+			return last_index, err
+		}
+
+		store.lock.Lock()
+		if state != store.watch_state {
+			store.watch_state = state
+			store.watch_index++
+		}
+		index := store.watch_index
+		store.lock.Unlock()
+
+		if index > last_index || time.Now().After(deadline) {
+			return index, nil
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// directoryState hashes the names, sizes and modification times of all files in the directory
+func (store *FileStore) directoryState() (string, error) {
+	hash := sha256.New()
+	err := filepath.WalkDir(store.directory, func(file_path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(hash, "%s:%d:%d\n", file_path, info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+	return hex.EncodeToString(hash.Sum(nil)), err
+}
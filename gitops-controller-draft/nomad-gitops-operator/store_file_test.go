@@ -0,0 +1,76 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testObjectDefinition returns the definition file of a GitRepository object at the path
+func testObjectDefinition(path string) string {
+	return `namespace = "default"
+path      = "` + path + `"
+items {
+  api_version     = "nomadops/v2"
+  kind            = "GitRepository"
+  controller_name = "nomadops"
+  spec            = "{}"
+}
+`
+}
+
+func TestFileStoreKeepsSidecars(t *testing.T) {
+	test_object_definition := testObjectDefinition("nomadops/v2/gitrepository/app")
+	tests := []struct {
+		name       string
+		definition string // replaces the definition after the status was written, removes it if empty
+	}{
+		{"definition fails to parse", strings.TrimSuffix(test_object_definition, "}\n")},
+		{"definition without items", `namespace = "default"` + "\n" + `path = "nomadops/v2/gitrepository/app"`},
+		{"definition deleted", ""},
+		{"definition of another object", testObjectDefinition("nomadops/v2/gitrepository/other")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			directory := t.TempDir()
+			definition_file := filepath.Join(directory, "app.hcl")
+			if err := os.WriteFile(definition_file, []byte(test_object_definition), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			store := NewFileStore(directory)
+			object, err := store.Get("nomadops/v2/gitrepository/app")
+			if err != nil || object == nil {
+				t.Fatalf("got %v, %v, want the defined object", object, err)
+			}
+			object.Items["status"] = `{"current_commit":"abc"}`
+			if err := store.Put(object); err != nil {
+				t.Fatal(err)
+			}
+
+			if test.definition == "" {
+				err = os.Remove(definition_file)
+			} else {
+				err = os.WriteFile(definition_file, []byte(test.definition), 0o644)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if object, err = store.Get("nomadops/v2/gitrepository/app"); err != nil || object != nil {
+				t.Fatalf("got %v, %v, want no object while it is not defined", object, err)
+			}
+			if _, err := os.Stat(definition_file + FILE_STORE_SIDECAR_SUFFIX); err != nil {
+				t.Fatalf("sidecar was removed by a read: %v", err)
+			}
+
+			// Once defined again, the object has its status back
+			if err := os.WriteFile(definition_file, []byte(test_object_definition), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			object, err = store.Get("nomadops/v2/gitrepository/app")
+			if err != nil || object == nil || object.Items["status"] != `{"current_commit":"abc"}` {
+				t.Fatalf("got %v, %v, want the object with its status", object, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/hashicorp/nomad/api"
+)
+
+// NomadVariableStore keeps objects as Nomad Variables, which are limited to 64KiB each
+type NomadVariableStore struct {
+	client    *api.Client
+	namespace string
+}
+
+func NewNomadVariableStore(client *api.Client, namespace string) *NomadVariableStore {
+	return &NomadVariableStore{client: client, namespace: namespace}
+}
+
+func (store *NomadVariableStore) List(prefix string) (objects []StoredObject, err error) {
+	variablemetadata, _, err := store.client.Variables().PrefixList(prefix, &api.QueryOptions{Namespace: store.namespace})
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range variablemetadata {
+		object, err := store.Get(v.Path)
+		if err != nil {
+			return nil, err
+		}
+		if object != nil { // deleted between listing and reading
+			objects = append(objects, *object)
+		}
+	}
+	return
+}
+
+func (store *NomadVariableStore) Get(path string) (*StoredObject, error) {
+	variable, _, err := store.client.Variables().Read(path, &api.QueryOptions{Namespace: store.namespace})
+	if errors.Is(err, api.ErrVariablePathNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &StoredObject{
+		Namespace:   variable.Namespace,
+		Path:        variable.Path,
+		Items:       variable.Items,
+		ModifyIndex: variable.ModifyIndex,
+	}, nil
+}
+
+func (store *NomadVariableStore) Put(object *StoredObject) error {
+	variable := &api.Variable{
+		Namespace:   object.Namespace,
+		Path:        object.Path,
+		Items:       object.Items,
+		ModifyIndex: object.ModifyIndex,
+	}
+	written, _, err := store.client.Variables().CheckedUpdate(variable, &api.WriteOptions{Namespace: object.Namespace})
+	if isCASConflict(err) {
+		return ErrObjectConflict
+	}
+	if err != nil {
+		return err
+	}
+	object.ModifyIndex = written.ModifyIndex
+	return nil
+}
+
+func (store *NomadVariableStore) Delete(path string, modify_index uint64) error {
+	_, err := store.client.Variables().CheckedDelete(path, modify_index, &api.WriteOptions{Namespace: store.namespace})
+	if isCASConflict(err) {
+		return ErrObjectConflict
+	}
+	return err
+}
+
+func (store *NomadVariableStore) WaitForChange(prefix string, last_index uint64, timeout time.Duration) (uint64, error) {
+	_, query_meta, err := store.client.Variables().PrefixList(prefix, &api.QueryOptions{
+		Namespace: store.namespace,
+		WaitIndex: last_index,
+		WaitTime:  timeout,
+	})
+	if err != nil {
+		return last_index, err
+	}
+	return query_meta.LastIndex, nil
+}
+
+func isCASConflict(err error) bool {
+	var conflict api.ErrCASConflict
+	return errors.As(err, &conflict)
+}
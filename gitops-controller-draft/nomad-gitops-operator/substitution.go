@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/nomad/api"
+)
+
+// Before job files are parsed, `${NAME}` placeholders in them are replaced with values read from the sources listed in
+// `substitute_from`, so that cluster-specific values do not have to be duplicated into every repository.
+//   - `${NAME:=fallback}` uses the fallback if NAME has no value
+//   - `$${NAME}` is an escape for a literal `${NAME}`
+//   - dotted names such as `${var.image}` or `${attr.kernel.name}`, and names starting with `NOMAD_`, are left to Nomad
+//   - unresolved placeholders are left as they are, unless `strict` is set, in which case the file fails
+const (
+	SUBSTITUTION_SOURCE_NOMAD_VARIABLE = "NomadVariable"
+	SUBSTITUTION_SOURCE_CONSUL_KV      = "ConsulKV"
+)
+
+var substitution_placeholder_regex = regexp.MustCompile(`\$\$\{|\$\{([_a-zA-Z][_a-zA-Z0-9]*)(?::=([^}]*))?\}`)
+
+// LoadSubstitutionValues reads the values of all sources of a NomadJobGroup, later sources taking precedence over
+// earlier ones, and all of them over `defaults`
+func LoadSubstitutionValues(client *api.Client, namespace string, spec SubstitutionSpec) (values map[string]string, err error) {
+	values = map[string]string{}
+	for name, value := range spec.Defaults {
+		values[name] = value
+	}
+
+	for _, source := range spec.SubstituteFrom {
+		source_values := map[string]string{}
+		switch source.Kind {
+		case SUBSTITUTION_SOURCE_NOMAD_VARIABLE:
+			variable, _, err := client.Variables().Read(source.Path, &api.QueryOptions{Namespace: namespace})
+			if errors.Is(err, api.ErrVariablePathNotFound) {
+				err = nil
+			} else if err == nil {
+				source_values = variable.Items
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to read substitution source %s: %w", source.Path, err)
+			}
+		case SUBSTITUTION_SOURCE_CONSUL_KV:
+			pairs, _, err := InitializeConsulApiClient().KV().List(source.Path, nil)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read substitution source %s: %w", source.Path, err)
+			}
+			for _, pair := range pairs {
+				if !strings.HasSuffix(pair.Key, "/") { // skip folders
+					source_values[path.Base(pair.Key)] = string(pair.Value)
+				}
+			}
+		default:
+			return nil, fmt.Errorf("unsupported substitution source kind %q", source.Kind)
+		}
+
+		if len(source_values) == 0 && !source.Optional {
+			return nil, fmt.Errorf("substitution source %s %s does not exist or is empty", source.Kind, source.Path)
+		}
+		for name, value := range source_values {
+			values[name] = value
+		}
+	}
+	return
+}
+
+// SubstituteVariables replaces the placeholders in a job file, returning an error for unresolved ones in strict mode
+func SubstituteVariables(contents string, values map[string]string, strict bool) (string, error) {
+	unresolved := map[string]bool{}
+	substituted := substitution_placeholder_regex.ReplaceAllStringFunc(contents, func(placeholder string) string {
+		if placeholder == "$${" {
+			return placeholder // escaped, kept for Nomad which handles `$${` the same way
+		}
+		match := substitution_placeholder_regex.FindStringSubmatch(placeholder)
+		name, has_fallback := match[1], strings.Contains(placeholder, ":=")
+		if strings.HasPrefix(name, "NOMAD_") {
+			return placeholder
+		}
+		if value, exists := values[name]; exists {
+			return value
+		}
+		if has_fallback {
+			return match[2]
+		}
+		unresolved[name] = true
+		return placeholder
+	})
+
+	if strict && len(unresolved) > 0 {
+		names := []string{}
+		for name := range unresolved {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return "", fmt.Errorf("unresolved substitution placeholders: %s", strings.Join(names, ", "))
+	}
+	return substituted, nil
+}
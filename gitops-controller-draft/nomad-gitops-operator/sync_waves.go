@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/nomad/api"
+)
+
+// The jobs of a NomadJobGroup are applied in stages, set through the meta of each job:
+//
+//	meta {
+//	  nomad_gitops_wave = "1"        # waves are applied in ascending order, 0 by default
+//	  nomad_gitops_hook = "pre-sync" # batch jobs only: `pre-sync` or `post-sync`
+//	}
+//
+// Waves are applied in ascending order, and within each wave first the pre-sync hooks run, then the main jobs are
+// registered, then the post-sync hooks run. Every stage waits for the previous one: deployments have to be successful,
+// and hooks have to complete with every allocation successful. E.g. a database in wave 0 is healthy before a migration
+// runs as a pre-sync hook of wave 1, which completes before the application in wave 1 is registered. The controller
+// doesn't block while a stage is in progress, it checks on it on each run and registers the next stage on the first run
+// after it finished. As hooks are only registered again when they change, and every commit changes the
+// `nomad_gitops_current_commit` meta, a hook runs once per commit. If a stage fails, later stages are not registered.
+//
+// The run of each hook is recorded in the status as `hook_runs`, with the commit and a hash of the job it ran as, so
+// that a hook that completed is not registered and run again once Nomad has garbage collected its job. A failed hook
+// whose job was garbage collected is registered again, i.e. retried.
+const (
+	WAVE_META_KEY  = "nomad_gitops_wave"
+	HOOK_META_KEY  = "nomad_gitops_hook"
+	HOOK_PRE_SYNC  = "pre-sync"
+	HOOK_POST_SYNC = "post-sync"
+
+	HOOK_RUN_STATUS_RUNNING = "running"
+)
+
+type SyncStage struct {
+	Name string
+	Jobs []int // indices of the jobs in this stage
+}
+
+// GetSyncStages groups jobs into the stages they are applied in, returning errors for jobs with invalid wave or hook meta
+func GetSyncStages(jobs []*api.Job) (stages []SyncStage, job_errors map[int]error) {
+	type stage_key struct{ phase, wave int }
+	jobs_by_stage := map[stage_key][]int{}
+	job_errors = map[int]error{}
+	for index, job := range jobs {
+		key := stage_key{phase: 1}
+		if wave, has_wave := job.Meta[WAVE_META_KEY]; has_wave {
+			parsed, err := strconv.Atoi(wave)
+			if err != nil {
+				job_errors[index] = fmt.Errorf("invalid %s meta %q, expected a number", WAVE_META_KEY, wave)
+				continue
+			}
+			key.wave = parsed
+		}
+		switch job.Meta[HOOK_META_KEY] {
+		case "":
+		case HOOK_PRE_SYNC, HOOK_POST_SYNC:
+			if job.Type == nil || *job.Type != api.JobTypeBatch {
+				job_errors[index] = fmt.Errorf("only batch jobs can be %s hooks", job.Meta[HOOK_META_KEY])
+				continue
+			}
+			key.phase = 0
+			if job.Meta[HOOK_META_KEY] == HOOK_POST_SYNC {
+				key.phase = 2
+			}
+		default:
+			job_errors[index] = fmt.Errorf("invalid %s meta %q, expected %s or %s", HOOK_META_KEY, job.Meta[HOOK_META_KEY], HOOK_PRE_SYNC, HOOK_POST_SYNC)
+			continue
+		}
+		jobs_by_stage[key] = append(jobs_by_stage[key], index)
+	}
+
+	keys := []stage_key{}
+	for key := range jobs_by_stage {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].wave < keys[j].wave || (keys[i].wave == keys[j].wave && keys[i].phase < keys[j].phase)
+	})
+	for _, key := range keys {
+		name := fmt.Sprintf("wave %d", key.wave)
+		switch key.phase {
+		case 0:
+			name = fmt.Sprintf("%s hooks of wave %d", HOOK_PRE_SYNC, key.wave)
+		case 2:
+			name = fmt.Sprintf("%s hooks of wave %d", HOOK_POST_SYNC, key.wave)
+		}
+		stages = append(stages, SyncStage{Name: name, Jobs: jobs_by_stage[key]})
+	}
+	return
+}
+
+func isHookJob(job *api.Job) bool {
+	return job.Meta[HOOK_META_KEY] != ""
+}
+
+// hookJobHash identifies the exact job a hook runs as, including the commit through its meta
+func hookJobHash(job *api.Job) string {
+	hash := sha256.Sum256([]byte(mustMarshalJSON(job)))
+	return hex.EncodeToString(hash[:])
+}
+
+// CompletedHookRun returns the recorded run of a hook job if it already completed as exactly this job, in which case
+// it is not registered again and its recorded outcome is reported, whether or not Nomad still knows the job
+func CompletedHookRun(hook_runs map[string]HookRun, job *api.Job, job_hash string) (HookRun, bool) {
+	run, exists := hook_runs[*job.ID]
+	if !exists || run.JobHash != job_hash || run.Status != api.DeploymentStatusSuccessful {
+		return HookRun{}, false
+	}
+	return run, true
+}
+
+// NewHookRun records the outcome of a hook job once it finished
+func NewHookRun(commit string, job_hash string, deployment *JobDeploymentStatus) HookRun {
+	return HookRun{
+		Commit:      commit,
+		JobHash:     job_hash,
+		Status:      deployment.Status,
+		Description: deployment.Description,
+		FinishedAt:  time.Now().Format(time.RFC3339),
+	}
+}
+
+// DeploymentStatus reports a recorded hook run the same way as checking on the hook job would
+func (run HookRun) DeploymentStatus() *JobDeploymentStatus {
+	return &JobDeploymentStatus{Status: run.Status, Description: run.Description + " at " + run.FinishedAt}
+}
+
+// CheckHookJob checks once whether a hook job has finished, i.e. all allocations of its current version are no longer
+// running, reporting it as successful only if every allocation completed. Like CheckDeployment, it continues from the
+// status tracked on earlier runs while the hook job is unchanged.
+func CheckHookJob(client *api.Client, job *api.Job, eval_id string, tracked *JobDeploymentStatus, timeout time.Duration) (*JobDeploymentStatus, error) {
+	query_options := &api.QueryOptions{Namespace: *job.Namespace}
+	if tracked != nil && tracked.Finished() {
+		return tracked, nil
+	}
+	status := newTrackedDeploymentStatus(tracked)
+	if eval_id != "" && (tracked == nil || tracked.Status == DEPLOYMENT_STATUS_PENDING) {
+		evaluation, failure, err := checkEvaluation(client, eval_id, query_options)
+		if err != nil || failure != nil {
+			return failure, err
+		}
+		if evaluation == nil {
+			status.Status = DEPLOYMENT_STATUS_PENDING
+			status.Description = "evaluation pending"
+			return status.checkTimeout(timeout), nil
+		}
+	}
+
+	current_job, _, err := client.Jobs().Info(*job.ID, query_options)
+	response_error := api.UnexpectedResponseError{}
+	if errors.As(err, &response_error) && response_error.StatusCode() == http.StatusNotFound {
+		return nil, errors.New("hook job was garbage collected before its outcome was recorded, it is registered again on the next run")
+	}
+	if err != nil {
+		return nil, err
+	}
+	allocations, _, err := client.Jobs().Allocations(*job.ID, false, query_options)
+	if err != nil {
+		return nil, err
+	}
+	for _, allocation := range allocations {
+		if allocation.JobVersion != *current_job.Version || allocation.NextAllocation != "" {
+			continue // only the latest attempts, not those that were rescheduled
+		}
+		status.DesiredAllocs++
+		switch allocation.ClientStatus {
+		case api.AllocClientStatusComplete:
+			status.HealthyAllocs++
+		case api.AllocClientStatusFailed, api.AllocClientStatusLost:
+			status.UnhealthyAllocs++
+		}
+	}
+
+	if *current_job.Status == "dead" {
+		status.Status = api.DeploymentStatusSuccessful
+		status.Description = fmt.Sprintf("hook completed, %d allocations successful", status.HealthyAllocs)
+		if status.UnhealthyAllocs > 0 || status.HealthyAllocs == 0 {
+			status.Status = api.DeploymentStatusFailed
+			status.Description = fmt.Sprintf("hook failed, %d of %d allocations unsuccessful", status.DesiredAllocs-status.HealthyAllocs, status.DesiredAllocs)
+		}
+		return status, nil
+	}
+	status.Status = api.DeploymentStatusRunning
+	status.Description = "hook " + *current_job.Status
+	return status.checkTimeout(timeout), nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// Sync windows restrict when a NomadJobGroup is reconciled. Each window opens on a standard cron schedule, optionally
+// with a `CRON_TZ=` prefix, and stays open for its duration:
+//
+//	"sync_windows": [
+//	  {"kind": "deny", "schedule": "0 15 * * 5", "duration": "57h"},
+//	  {"kind": "deny", "schedule": "CRON_TZ=Europe/Helsinki 0 0 20 12 *", "duration": "336h"}
+//	]
+//
+// i.e. no syncing from Friday 15:00 until Monday, nor during a two-week holiday freeze from December 20th.
+// Syncing is denied while any deny window is open, and, if there are allow windows, while none of them is open.
+// Windows in NOMAD_GITOPS_SYNC_WINDOWS, a JSON list in the same format, apply to every group in addition to its own.
+// Outside the windows, new commits are recorded as pending but not applied, unless overridden through the API.
+const (
+	SYNC_WINDOW_ALLOW = "allow"
+	SYNC_WINDOW_DENY  = "deny"
+
+	MAX_SYNC_WINDOW_STEPS = 10000 // window openings and closings to look ahead when searching for the next sync window
+)
+
+var (
+	sync_window_overrides      = map[string]time.Time{} // overrides set through the API, by NomadJobGroup path
+	sync_window_overrides_lock sync.Mutex
+)
+
+type syncWindowSchedule struct {
+	kind     string
+	schedule cron.Schedule
+	duration time.Duration
+}
+
+// GetSyncWindowSchedules parses the windows of a NomadJobGroup together with the global windows
+func GetSyncWindowSchedules(windows []SyncWindow) (schedules []syncWindowSchedule, err error) {
+	if SYNC_WINDOWS != "" {
+		global_windows := []SyncWindow{}
+		err = json.Unmarshal([]byte(SYNC_WINDOWS), &global_windows)
+		if err != nil {
+			return nil, fmt.Errorf("invalid NOMAD_GITOPS_SYNC_WINDOWS: %w", err)
+		}
+		windows = append(global_windows, windows...)
+	}
+	for _, window := range windows {
+		if window.Kind != SYNC_WINDOW_ALLOW && window.Kind != SYNC_WINDOW_DENY {
+			return nil, fmt.Errorf("invalid sync window kind %q, expected %s or %s", window.Kind, SYNC_WINDOW_ALLOW, SYNC_WINDOW_DENY)
+		}
+		schedule, err := cron.ParseStandard(window.Schedule)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sync window schedule %q: %w", window.Schedule, err)
+		}
+		duration, err := time.ParseDuration(window.Duration)
+		if err != nil || duration <= 0 {
+			return nil, fmt.Errorf("invalid sync window duration %q", window.Duration)
+		}
+		schedules = append(schedules, syncWindowSchedule{kind: window.Kind, schedule: schedule, duration: duration})
+	}
+	return
+}
+
+// openedAt returns when the window last opened if it is open at the given time, or the zero time if it is closed
+func (window syncWindowSchedule) openedAt(at time.Time) time.Time {
+	opened := time.Time{}
+	for start := window.schedule.Next(at.Add(-window.duration)); !start.After(at); start = window.schedule.Next(start) {
+		opened = start
+	}
+	return opened
+}
+
+// IsSyncAllowed returns whether syncing is allowed at the given time
+func IsSyncAllowed(schedules []syncWindowSchedule, at time.Time) bool {
+	has_allow_windows, in_allow_window := false, false
+	for _, window := range schedules {
+		is_open := !window.openedAt(at).IsZero()
+		if window.kind == SYNC_WINDOW_DENY && is_open {
+			return false
+		}
+		if window.kind == SYNC_WINDOW_ALLOW {
+			has_allow_windows = true
+			in_allow_window = in_allow_window || is_open
+		}
+	}
+	return !has_allow_windows || in_allow_window
+}
+
+// NextSyncWindow returns when syncing is next allowed after the given time, stepping through the times windows open
+// and close, or the zero time if that is too far ahead
+func NextSyncWindow(schedules []syncWindowSchedule, after time.Time) time.Time {
+	at := after
+	for step := 0; step < MAX_SYNC_WINDOW_STEPS; step++ {
+		next := time.Time{}
+		for _, window := range schedules {
+			candidates := []time.Time{window.schedule.Next(at)}
+			if opened := window.openedAt(at); !opened.IsZero() {
+				candidates = append(candidates, opened.Add(window.duration))
+			}
+			for _, candidate := range candidates {
+				if candidate.After(at) && (next.IsZero() || candidate.Before(next)) {
+					next = candidate
+				}
+			}
+		}
+		if next.IsZero() {
+			return next
+		}
+		if IsSyncAllowed(schedules, next) {
+			return next
+		}
+		at = next
+	}
+	return time.Time{}
+}
+
+// SetSyncWindowOverride lets a NomadJobGroup sync regardless of its windows until the given time, the zero time to
+// remove the override. It is stored in the group's status on its next reconciliation.
+func SetSyncWindowOverride(path string, until time.Time) {
+	sync_window_overrides_lock.Lock()
+	defer sync_window_overrides_lock.Unlock()
+	sync_window_overrides[path] = until
+}
+
+// takeSyncWindowOverride returns the override set through the API since the last reconciliation of the group, if any
+func takeSyncWindowOverride(path string) (until time.Time, exists bool) {
+	sync_window_overrides_lock.Lock()
+	defer sync_window_overrides_lock.Unlock()
+	until, exists = sync_window_overrides[path]
+	delete(sync_window_overrides, path)
+	return
+}
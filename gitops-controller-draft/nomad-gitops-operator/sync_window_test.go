@@ -0,0 +1,127 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+var (
+	test_weekend_freeze = SyncWindow{Kind: SYNC_WINDOW_DENY, Schedule: "CRON_TZ=UTC 0 15 * * 5", Duration: "57h"}
+	test_office_hours   = SyncWindow{Kind: SYNC_WINDOW_ALLOW, Schedule: "CRON_TZ=UTC 0 9 * * 1-5", Duration: "8h"}
+)
+
+func testTime(t *testing.T, value string) time.Time {
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+func TestGetSyncWindowSchedules(t *testing.T) {
+	tests := []struct {
+		name           string
+		windows        []SyncWindow
+		global_windows string
+		schedules      int
+		fails          bool
+	}{
+		{"none", nil, "", 0, false},
+		{"valid", []SyncWindow{test_weekend_freeze, test_office_hours}, "", 2, false},
+		{"with global windows", []SyncWindow{test_office_hours}, `[{"kind":"deny","schedule":"0 0 20 12 *","duration":"336h"}]`, 2, false},
+		{"invalid global windows", nil, `{"kind":"deny"}`, 0, true},
+		{"invalid kind", []SyncWindow{{Kind: "block", Schedule: "0 15 * * 5", Duration: "1h"}}, "", 0, true},
+		{"invalid schedule", []SyncWindow{{Kind: SYNC_WINDOW_DENY, Schedule: "friday", Duration: "1h"}}, "", 0, true},
+		{"invalid duration", []SyncWindow{{Kind: SYNC_WINDOW_DENY, Schedule: "0 15 * * 5", Duration: "a day"}}, "", 0, true},
+		{"zero duration", []SyncWindow{{Kind: SYNC_WINDOW_DENY, Schedule: "0 15 * * 5", Duration: "0s"}}, "", 0, true},
+	}
+	defer func(sync_windows string) { SYNC_WINDOWS = sync_windows }(SYNC_WINDOWS)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			SYNC_WINDOWS = test.global_windows
+			schedules, err := GetSyncWindowSchedules(test.windows)
+			if (err != nil) != test.fails {
+				t.Fatalf("got error %v, want failure %v", err, test.fails)
+			}
+			if len(schedules) != test.schedules {
+				t.Fatalf("got %d schedules, want %d", len(schedules), test.schedules)
+			}
+		})
+	}
+}
+
+func TestIsSyncAllowed(t *testing.T) {
+	// 2026-10-16 is a Friday
+	tests := []struct {
+		name    string
+		windows []SyncWindow
+		at      string
+		allowed bool
+	}{
+		{"no windows", nil, "2026-10-17T12:00:00Z", true},
+		{"before the deny window", []SyncWindow{test_weekend_freeze}, "2026-10-16T14:59:00Z", true},
+		{"deny window opens", []SyncWindow{test_weekend_freeze}, "2026-10-16T15:00:00Z", false},
+		{"in the deny window", []SyncWindow{test_weekend_freeze}, "2026-10-18T12:00:00Z", false},
+		{"deny window closed", []SyncWindow{test_weekend_freeze}, "2026-10-19T00:00:00Z", true},
+		{"in the allow window", []SyncWindow{test_office_hours}, "2026-10-20T10:00:00Z", true},
+		{"after the allow window", []SyncWindow{test_office_hours}, "2026-10-20T18:00:00Z", false},
+		{"outside allowed days", []SyncWindow{test_office_hours}, "2026-10-17T10:00:00Z", false},
+		{"deny wins over allow", []SyncWindow{test_office_hours, test_weekend_freeze}, "2026-10-16T16:00:00Z", false},
+		{"allow without deny", []SyncWindow{test_office_hours, test_weekend_freeze}, "2026-10-16T14:00:00Z", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			schedules, err := GetSyncWindowSchedules(test.windows)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if allowed := IsSyncAllowed(schedules, testTime(t, test.at)); allowed != test.allowed {
+				t.Fatalf("got %v, want %v", allowed, test.allowed)
+			}
+		})
+	}
+}
+
+func TestNextSyncWindow(t *testing.T) {
+	tests := []struct {
+		name     string
+		windows  []SyncWindow
+		after    string
+		expected string // empty for the zero time
+	}{
+		{"no windows", nil, "2026-10-17T12:00:00Z", ""},
+		{"end of the deny window", []SyncWindow{test_weekend_freeze}, "2026-10-17T12:00:00Z", "2026-10-19T00:00:00Z"},
+		{"start of the allow window", []SyncWindow{test_office_hours}, "2026-10-16T18:00:00Z", "2026-10-19T09:00:00Z"},
+		{"allow window after the deny window", []SyncWindow{test_office_hours, test_weekend_freeze}, "2026-10-16T16:00:00Z", "2026-10-19T09:00:00Z"},
+		{"allow window always denied", []SyncWindow{test_office_hours, {Kind: SYNC_WINDOW_DENY, Schedule: "CRON_TZ=UTC 0 0 * * *", Duration: "24h"}}, "2026-10-16T16:00:00Z", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			schedules, err := GetSyncWindowSchedules(test.windows)
+			if err != nil {
+				t.Fatal(err)
+			}
+			next := NextSyncWindow(schedules, testTime(t, test.after))
+			if test.expected == "" {
+				if !next.IsZero() {
+					t.Fatalf("got %s, want no next window", next)
+				}
+				return
+			}
+			if !next.Equal(testTime(t, test.expected)) {
+				t.Fatalf("got %s, want %s", next, test.expected)
+			}
+		})
+	}
+}
+
+func TestTakeSyncWindowOverride(t *testing.T) {
+	until := time.Date(2026, 10, 16, 18, 0, 0, 0, time.UTC)
+	SetSyncWindowOverride("app", until)
+	if taken, exists := takeSyncWindowOverride("app"); !exists || !taken.Equal(until) {
+		t.Fatalf("got %s, %v, want %s", taken, exists, until)
+	}
+	if _, exists := takeSyncWindowOverride("app"); exists {
+		t.Fatal("override is taken only once")
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -10,7 +11,10 @@ import (
 	"path"
 	"path/filepath"
 	"regexp"
+	"strconv"
 
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/hashicorp/hcl/v2/hclparse"
 	"github.com/hashicorp/nomad/api"
 	"github.com/mitchellh/mapstructure"
 	"go.uber.org/zap"
@@ -28,15 +32,31 @@ func GetEnv(key, defaultValue string) string {
 	}
 }
 
+// GetSecretEnv is GetEnv for secrets, which are not logged
+func GetSecretEnv(key string) string {
+	value := os.Getenv(key)
+	logger = zap.L()
+	logger.Info(fmt.Sprintf("config: secret configurable variable %s is set: %t", key, len(value) > 0))
+	return value
+}
+
 func GetObjectNameFromVariablePath(path string) string {
-	return regexp.MustCompile(`/v1/([^/]+)`).FindStringSubmatch(path)[1]
+	return regexp.MustCompile(`/v[0-9]+/([^/]+)`).FindStringSubmatch(path)[1]
+}
+
+// GetVariablePathPrefixes returns the path prefixes of an object type (e.g. `nomadjobgroup`) for all supported versions
+func GetVariablePathPrefixes(object_type string) (prefixes []string) {
+	for _, version := range NOMAD_VAR_PATH_VERSIONS {
+		prefixes = append(prefixes, NOMAD_VAR_PREFIX+version+"/"+object_type+"/")
+	}
+	return
 }
 
 func getMapStructureDecoder(result_interface interface{}) *mapstructure.Decoder {
 
 	decoder_config := mapstructure.DecoderConfig{
-		ErrorUnset:       true,  // omission of any keys in the Nomad var will cause error
-		ErrorUnused:      true,  // randomly added keys in Nomad vars will cause error
+		ErrorUnset:       false, // optional keys such as `status` may be omitted, required ones are checked in `decodeStoredObject`
+		ErrorUnused:      true,  // randomly added keys in Nomad vars will cause error, new fields belong in `spec`/`status`
 		TagName:          "hcl", // Share the struct tag with HCL
 		WeaklyTypedInput: true,  // Every entry in Nomad variables is a string, this was set so we can collect `true`/`false` values from HCL booleans correctly
 		Result:           &result_interface,
@@ -48,63 +68,125 @@ func getMapStructureDecoder(result_interface interface{}) *mapstructure.Decoder
 	return decoder
 }
 
-func ConvertVariableToNomadJobGroupStruct(variables []api.Variable) (nomad_job_objects []NomadJobGroupObject) {
-	for _, variable := range variables {
-		nomad_job_object_items := NomadJobGroupObjectItems{}
+// decodeStoredObject checks the schema of a stored object and decodes its `spec` and `status` documents
+func decodeStoredObject(object StoredObject, expected_kind string, spec interface{}, status interface{}) (meta ObjectMeta, err error) {
+	if IsFlatObject(object) {
+		return decodeFlatObject(object, expected_kind, spec, status)
+	}
+	object_items := ObjectItems{}
+	err = getMapStructureDecoder(&object_items).Decode(object.Items)
+	if err != nil {
+		return
+	}
+	if object_items.Kind != expected_kind {
+		return meta, fmt.Errorf("expected kind %q, got %q", expected_kind, object_items.Kind)
+	}
+	if object_items.Spec == "" {
+		return meta, errors.New("object has no spec")
+	}
+
+	generation, err := parseGeneration(object_items.Generation)
+	if err != nil {
+		return
+	}
+	err = decodeSpecDocument(object_items.ApiVersion, object_items.Spec, spec)
+	if err != nil {
+		return meta, fmt.Errorf("failed to decode spec: %w", err)
+	}
+	decodeStatus(object, object_items.Status, status)
+
+	meta = ObjectMeta{
+		OriginalObject:  &object,
+		Namespace:       object.Namespace,
+		Path:            object.Path,
+		ApiVersion:      object_items.ApiVersion,
+		Kind:            object_items.Kind,
+		ControllerName:  object_items.ControllerName,
+		Generation:      generation,
+		OwnerPath:       object_items.OwnerPath,
+		OwnerSourceFile: object_items.OwnerSourceFile,
+	}
+	return
+}
+
+// parseGeneration parses the generation item of an object, which the controller sets once it has seen the object
+func parseGeneration(generation_item string) (int64, error) {
+	if generation_item == "" {
+		return 1, nil
+	}
+	generation, err := strconv.ParseInt(generation_item, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse generation: %w", err)
+	}
+	return generation, nil
+}
+
+// decodeStatus decodes the status item of an object, if any, leaving the status empty if it can't be decoded
+func decodeStatus(object StoredObject, status_item string, status interface{}) {
+	if status_item == "" {
+		return
+	}
+	// An unreadable status is not a reason to stop reconciling the object, it is rewritten on the next update
+	status_document, err := decodeStatusItem(status_item, object.StatusShards)
+	if err == nil {
+		err = json.Unmarshal([]byte(status_document), status)
+	}
+	if err != nil {
+		logger.Warn("failed to decode status, continuing with an empty status",
+			zap.String("variablePath", object.Path),
+			zap.Error(err),
+		)
+	}
+}
 
-		decoder := getMapStructureDecoder(&nomad_job_object_items)
-		err := decoder.Decode(variable.Items)
+func ConvertObjectToNomadJobGroupStruct(objects []StoredObject) (nomad_job_objects []NomadJobGroupObject) {
+	for _, object := range objects {
+		nomad_job_object := NomadJobGroupObject{}
+		meta, err := decodeStoredObject(object, OBJECT_KIND_NOMAD_JOB_GROUP, &nomad_job_object.Spec, &nomad_job_object.Status)
 		if err != nil {
-			logger.Error("failed to decode variable's items block to expected format",
+			logger.Error("failed to decode object's items to expected format",
+				zap.String("variablePath", object.Path),
 				zap.Error(err))
 			continue
 		}
-
-		// Convert the object's Items to a NomadObjectItems struct
-		nomad_job_objects = append(nomad_job_objects, NomadJobGroupObject{
-			Namespace:        variable.Namespace,
-			Path:             variable.Path,
-			Items:            nomad_job_object_items,
-			OriginalVariable: &variable,
-		},
-		)
+		nomad_job_object.ObjectMeta = meta
+		nomad_job_objects = append(nomad_job_objects, nomad_job_object)
 	}
 	return
 }
 
-func ConvertVariableToGitRepositoryStruct(variables []api.Variable) (git_repository_objects []GitRepositoryObject) {
-	for _, variable := range variables {
-
-		// PATCHERS: Add empty values for status_ fields if not set in items currently
-		if _, exists := variable.Items["status_current_commit"]; !exists {
-			variable.Items["status_current_commit"] = ""
-		}
-
-		git_repository_object_items := GitRepositoryObjectItems{}
-
-		decoder := getMapStructureDecoder(&git_repository_object_items)
-		err := decoder.Decode(variable.Items)
+func ConvertObjectToGitRepositoryStruct(objects []StoredObject) (git_repository_objects []GitRepositoryObject) {
+	for _, object := range objects {
+		git_repository_object := GitRepositoryObject{}
+		meta, err := decodeStoredObject(object, OBJECT_KIND_GIT_REPOSITORY, &git_repository_object.Spec, &git_repository_object.Status)
 		if err != nil {
-			logger.Error("failed to decode variable's items block to expected format",
+			logger.Error("failed to decode object's items to expected format",
+				zap.String("variablePath", object.Path),
 				zap.Error(err))
 			continue
 		}
+		git_repository_object.ObjectMeta = meta
+		git_repository_objects = append(git_repository_objects, git_repository_object)
+	}
+	return
+}
 
-		// Convert the object's Items to a NomadObjectItems struct
-		git_repository_objects = append(git_repository_objects, GitRepositoryObject{
-			Namespace:        variable.Namespace,
-			Path:             variable.Path,
-			Items:            git_repository_object_items,
-			OriginalVariable: &variable,
-		},
-		)
+// ParseObjectFile decodes an object definition file, in the same format as used with `nomad var put`
+func ParseObjectFile(file_contents_bytes []byte, file_name string) (object_file ObjectFile, err error) {
+	object_hcl, diagnostics := hclparse.NewParser().ParseHCL(file_contents_bytes, file_name)
+	if diagnostics.HasErrors() {
+		return object_file, diagnostics
+	}
+	diagnostics = gohcl.DecodeBody(object_hcl.Body, nil, &object_file)
+	if diagnostics.HasErrors() {
+		return object_file, diagnostics
 	}
 	return
 }
 
 func GetGitRepositoryForNomadJobGroup(job NomadJobGroupObject, repositories *[]GitRepositoryObject) (GitRepositoryObject, error) {
 	for _, repo := range *repositories {
-		if repo.Path == job.Items.GitRepositoryName {
+		if repo.Path == job.Spec.SourceRef {
 			return repo, nil
 		}
 	}
@@ -115,40 +197,11 @@ func GetPathForRepository(repo GitRepositoryObject) (base_path_plus_hash string)
 	// Compute base64 hash of the GitRepository object Path (=name), so that we have no collisions
 	// This might be needed if several sources target the same repository but e.g. different branch/revision
 	hashed_path_name := base64.RawURLEncoding.EncodeToString([]byte(repo.Path))
-	repo_name := path.Base(repo.Items.Url)
+	repo_name := path.Base(repo.Spec.Url)
 	base_path_plus_hash = filepath.Join(controller_git_clone_base_path, hashed_path_name, repo_name)
 	return
 }
 
-func FilterFilePathsFromGivenDirectoryAndRegex(directory string, regex string) (filtered_file_paths []os.DirEntry, err error) {
-	files_in_dir, err := os.ReadDir(
-		directory,
-	)
-	if (err != nil) || len(files_in_dir) == 0 {
-		return filtered_file_paths, errors.New("directory is inaccessible or empty")
-	}
-
-	// Filter filepaths with given regex
-	for _, file_path := range files_in_dir {
-		matches_path_filter, err := regexp.MatchString(regex, file_path.Name())
-		if err != nil {
-			logger.Error("regex error when matching path filter to a filename",
-				zap.String("fileName", file_path.Name()),
-				zap.Error(err),
-			)
-		}
-		if matches_path_filter {
-			logger.Debug("file found matching filter",
-				zap.String("directory", directory),
-				zap.String("regex", regex),
-				zap.String("fileName", file_path.Name()),
-			)
-			filtered_file_paths = append(filtered_file_paths, file_path)
-		}
-	}
-	return
-}
-
 func InitializeNomadApiClient(clientConfig *api.Config) (client *api.Client) {
 	client, err := api.NewClient(clientConfig)
 	if err != nil {
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"strconv"
+
+	"go.uber.org/zap"
+)
+
+// UpdateObjectStatus replaces only the `status` document of an object, leaving the user-owned fields untouched.
+// The object is re-read first so that edits made to the spec while reconciling are not overwritten.
+// Large statuses are compressed and sharded, see status_encoding.go.
+func UpdateObjectStatus(store ObjectStore, meta ObjectMeta, status interface{}) error {
+	object, err := store.Get(meta.Path)
+	if err != nil {
+		return err
+	}
+	if object == nil {
+		return fmt.Errorf("object %s no longer exists", meta.Path)
+	}
+	err = writeStatusItem(store, object, status)
+	if err != nil {
+		return err
+	}
+	return store.Put(object)
+}
+
+func UpdateGitRepositoryStatus(store ObjectStore, repo GitRepositoryObject) error {
+	return UpdateObjectStatus(store, repo.ObjectMeta, &repo.Status)
+}
+
+func UpdateNomadJobGroupStatus(store ObjectStore, job NomadJobGroupObject) error {
+	return UpdateObjectStatus(store, job.ObjectMeta, &job.Status)
+}
+
+// ApplyGeneratedObject creates or updates an object generated by the controller from a definition file,
+// recording the NomadJobGroup that owns it and the file it came from.
+// The stored status is kept as is, and the generation is bumped only when the spec has actually changed.
+func ApplyGeneratedObject(store ObjectStore, object *StoredObject, owner_path string, owner_source_file string) error {
+	change, err := prepareGeneratedObject(store, object, owner_path, owner_source_file)
+	if err != nil || change == "" {
+		return err // nothing to update, avoid rewriting the object on every run
+	}
+	return store.Put(object)
+}
+
+// prepareGeneratedObject sets the controller-owned items of a generated object from the stored one, returning whether
+// it needs to be created or updated, or an empty string if it is unchanged
+func prepareGeneratedObject(store ObjectStore, object *StoredObject, owner_path string, owner_source_file string) (change string, err error) {
+	existing, err := store.Get(object.Path)
+	if err != nil {
+		return "", err
+	}
+
+	if existing != nil && existing.Items["owner_path"] != "" && existing.Items["owner_path"] != owner_path {
+		return "", fmt.Errorf("object is already owned by %s", existing.Items["owner_path"])
+	}
+	if WouldCreateOwnershipCycle(store, owner_path, object.Path) {
+		// e.g. a group defining itself - the definition is still applied, but the object is never garbage collected by its own
+		logger.Warn("not recording ownership of object as its owner is the object itself or one of its descendants",
+			zap.String("variablePath", object.Path),
+			zap.String("ownerPath", owner_path),
+		)
+		delete(object.Items, "owner_path")
+		delete(object.Items, "owner_source_file")
+	} else {
+		setOwnerItems(object, owner_path, owner_source_file)
+	}
+
+	generation := int64(1)
+	object.ModifyIndex = 0
+	change = OBJECT_CHANGE_CREATE
+	if existing != nil {
+		change = OBJECT_CHANGE_UPDATE
+		existing_generation, _ := strconv.ParseInt(existing.Items["generation"], 10, 64)
+		generation = max(existing_generation, 1)
+		spec_changed := !jsonDocumentsEqual(existing.Items["spec"], object.Items["spec"])
+		unchanged := !spec_changed
+		for _, key := range []string{"api_version", "kind", "controller_name", "owner_path", "owner_source_file"} {
+			unchanged = unchanged && existing.Items[key] == object.Items[key]
+		}
+		if unchanged {
+			return "", nil
+		}
+		if spec_changed {
+			generation++
+		}
+		object.Items["status"] = existing.Items["status"]
+		object.ModifyIndex = existing.ModifyIndex
+	}
+	object.Items["generation"] = strconv.FormatInt(generation, 10)
+	object.Items["spec_hash"] = hashUserOwnedItems(object.Items)
+	return change, nil
+}
+
+// RefreshObjectGeneration bumps the generation of an object whose user-owned items changed since the controller last
+// saw them, e.g. after `nomad var put`, so that `observed_generation` shows whether the status reflects the current spec.
+// The first time an object is seen, only the hash of its items is recorded.
+func RefreshObjectGeneration(store ObjectStore, meta *ObjectMeta) {
+	object := meta.OriginalObject
+	spec_hash := hashUserOwnedItems(object.Items)
+	if object.Items["spec_hash"] == spec_hash {
+		return
+	}
+	if object.Items["spec_hash"] != "" {
+		meta.Generation++
+	}
+
+	updated := *object
+	updated.Items = maps.Clone(object.Items)
+	updated.Items["generation"] = strconv.FormatInt(meta.Generation, 10)
+	updated.Items["spec_hash"] = spec_hash
+	err := store.Put(&updated)
+	if err != nil {
+		// The object is still reconciled at its new generation, which is recomputed the same way on the next read
+		logger.Warn("failed to record the generation of object",
+			zap.String("variablePath", meta.Path),
+			zap.Error(err),
+		)
+		return
+	}
+	meta.OriginalObject = &updated
+}
+
+// hashUserOwnedItems hashes all items except those written by the controller, with JSON documents compacted
+func hashUserOwnedItems(items map[string]string) string {
+	keys := []string{}
+	for key := range items {
+		if !slices.Contains(CONTROLLER_OWNED_ITEMS, key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	hash := sha256.New()
+	for _, key := range keys {
+		value := items[key]
+		var compact bytes.Buffer
+		if json.Compact(&compact, []byte(value)) == nil {
+			value = compact.String()
+		}
+		fmt.Fprintf(hash, "%s=%q\n", key, value)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func jsonDocumentsEqual(a string, b string) bool {
+	var compact_a, compact_b bytes.Buffer
+	if json.Compact(&compact_a, []byte(a)) != nil || json.Compact(&compact_b, []byte(b)) != nil {
+		return a == b
+	}
+	return compact_a.String() == compact_b.String()
+}